@@ -0,0 +1,338 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	cstorage "cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+var (
+	approvalTags   stringsFlag
+	approvalExpiry = flag.Duration("approval-expiry", time.Hour, "How long an approval request can be approved for, and so how long cdbuild waits.")
+)
+
+func init() {
+	flag.Var(&approvalTags, "approval-tag", "Tag pattern, such as prod or prod-*, for which the image tag or a -promote tag needs approval by a second person with cdbuild approve before anything is submitted. May be repeated.")
+}
+
+// approvalPrefix is the prefix of approval requests in the staging bucket,
+// and of approvals in the approvals bucket. A request is approved once its
+// approval object exists.
+const approvalPrefix = "approvals/"
+
+// approvalsBucket returns the name of the bucket that approvals of builds in
+// project are written to. Unlike the staging bucket, which anyone who builds
+// can write to, only approvers may write to it, so that an approval cannot be
+// forged by the requester.
+func approvalsBucket(project string) string { return "cdbuild-approvals-" + project }
+
+// approvalRequest is a pending request for approval of a build.
+type approvalRequest struct {
+	ID        string    `json:"id"`
+	Project   string    `json:"project"`
+	Image     string    `json:"image"`
+	Tags      []string  `json:"tags"` // The tags that need approval.
+	Requester string    `json:"requester"`
+	Host      string    `json:"host"`
+	GitCommit string    `json:"gitCommit,omitempty"`
+	GitDirty  bool      `json:"gitDirty,omitempty"` // There were uncommitted changes.
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// approval records who approved a request, and the digest of the request
+// object as the approver read it, so that a request changed after it was
+// written is not approved.
+type approval struct {
+	ID            string    `json:"id"`
+	RequestDigest string    `json:"requestDigest"`
+	Approver      string    `json:"approver"`
+	Time          time.Time `json:"time"`
+}
+
+func requestObject(id string) string  { return approvalPrefix + id + ".json" }
+func approvalObject(id string) string { return approvalPrefix + id + ".approved.json" }
+
+// protectedTags returns the tags of image, and those it is promoted to, that
+// match an -approval-tag pattern.
+func protectedTags(image string) []string {
+	_, tag := splitTag(image)
+	tags := append([]string{tag}, promoteTags...)
+	var out []string
+	for _, t := range tags {
+		for _, p := range approvalTags {
+			if ok, _ := path.Match(p, t); ok && t != "" {
+				out = append(out, t)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// awaitApproval writes a request to approve the build of pb to the staging
+// bucket, and waits until a different identity approves it with cdbuild
+// approve, or until the request expires.
+func (pb *projectBuild) awaitApproval(ctx context.Context, c *cstorage.Client, tags []string) (*approval, error) {
+	requester, err := callerIdentity(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get caller identity: %v", err)
+	}
+	approvals := c.Bucket(approvalsBucket(pb.project))
+	if err := checkCannotApprove(ctx, approvals); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	req := &approvalRequest{
+		ID:        strings.SplitN(uuid.Must(uuid.NewV4()).String(), "-", 2)[0],
+		Project:   pb.project,
+		Image:     pb.image,
+		Tags:      tags,
+		Requester: requester,
+		Host:      host,
+		Created:   now,
+		Expires:   now.Add(*approvalExpiry),
+	}
+	req.GitCommit, req.GitDirty = gitHead()
+	digest, err := writeNewObject(ctx, c.Bucket(pb.bucket).Object(requestObject(req.ID)), req)
+	if err != nil {
+		return nil, fmt.Errorf("could not write approval request: %v", err)
+	}
+	pb.log.Warn("Waiting for approval by someone else",
+		"phase", "approval", "request_id", req.ID, "tags", strings.Join(tags, ","), "expires", req.Expires.Format(time.RFC3339),
+		"approve", fmt.Sprintf("cdbuild approve -project %s %s", pb.project, req.ID))
+
+	obj := approvals.Object(approvalObject(req.ID))
+	for {
+		var a approval
+		_, err := readObject(ctx, obj, &a)
+		if err == nil {
+			if err := req.checkApproval(&a, digest); err != nil {
+				return nil, err
+			}
+			return &a, nil
+		}
+		if err != cstorage.ErrObjectNotExist {
+			return nil, err
+		}
+		if time.Now().After(req.Expires) {
+			return nil, fmt.Errorf("approval request %s expired at %s", req.ID, req.Expires.Format(time.RFC3339))
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// checkCannotApprove checks that the caller cannot write to the approvals
+// bucket, and so cannot approve their own request by writing an approval
+// with someone else's name in it.
+func checkCannotApprove(ctx context.Context, approvals *cstorage.BucketHandle) error {
+	granted, err := approvals.IAM().TestPermissions(ctx, []string{"storage.objects.create"})
+	if err != nil {
+		if isAPINotFound(err) {
+			return fmt.Errorf("approvals bucket gs://%s does not exist; run cdbuild init -approver", approvals.BucketName())
+		}
+		return fmt.Errorf("could not check access to approvals bucket gs://%s: %v", approvals.BucketName(), err)
+	}
+	if len(granted) > 0 {
+		return fmt.Errorf("you can write to the approvals bucket gs://%s, so could approve your own request; only approvers should have write access", approvals.BucketName())
+	}
+	return nil
+}
+
+// checkApproval checks that a approves req, whose object had the given
+// digest when it was written, and that it was not approved by its requester.
+func (req *approvalRequest) checkApproval(a *approval, digest string) error {
+	if a.RequestDigest != digest {
+		return fmt.Errorf("request %s was changed after it was written; the approval by %s is for a request with digest %s, not %s", req.ID, a.Approver, a.RequestDigest, digest)
+	}
+	if a.Approver == req.Requester {
+		return fmt.Errorf("request %s was approved by its requester %s", req.ID, a.Approver)
+	}
+	return nil
+}
+
+// writeNewObject writes v as JSON to obj, which must not already exist, and
+// returns the digest of what it wrote.
+func writeNewObject(ctx context.Context, obj *cstorage.ObjectHandle, v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	w := obj.If(cstorage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(b); err != nil {
+		w.CloseWithError(err)
+		return "", err
+	}
+	return digestOf(b), w.Close()
+}
+
+// readObject decodes the JSON object obj into v, and returns the digest of
+// what it read.
+func readObject(ctx context.Context, obj *cstorage.ObjectHandle, v interface{}) (string, error) {
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return digestOf(b), json.Unmarshal(b, v)
+}
+
+func (a *approval) print(w io.Writer) {
+	fmt.Fprintf(w, "Approved by %s (request %s)\n", a.Approver, a.ID)
+}
+
+func approveCmd(args []string) {
+	fs := commandFlags("approve", "[request-id]")
+	parseCommandFlags(fs, args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	hc, err := google.DefaultClient(ctx, storage.CloudPlatformScope)
+	if err != nil {
+		fatal(logger, "Could not get authenticated HTTP client", err)
+	}
+	traceHTTP(hc)
+	c, err := cstorage.NewClient(ctx, option.WithHTTPClient(hc))
+	if err != nil {
+		fatal(logger, "Could not make Cloud storage client", err)
+	}
+	defer c.Close()
+	bucket := c.Bucket("cdbuild-" + *projectID)
+	approvals := c.Bucket(approvalsBucket(*projectID))
+
+	if fs.NArg() == 0 {
+		if err := listApprovals(ctx, bucket, approvals, os.Stdout); err != nil {
+			fatal(logger, "Could not list approval requests", err)
+		}
+		return
+	}
+
+	id := fs.Arg(0)
+	var req approvalRequest
+	digest, err := readObject(ctx, bucket.Object(requestObject(id)), &req)
+	if err != nil {
+		if err == cstorage.ErrObjectNotExist {
+			err = errors.New("no such request")
+		}
+		fatal(logger, "Could not read approval request", err, "request_id", id)
+	}
+	fmt.Printf("Request %s from %s on %s\n", req.ID, req.Requester, req.Host)
+	fmt.Printf("  image:   %s\n", req.Image)
+	fmt.Printf("  tags:    %s\n", strings.Join(req.Tags, ", "))
+	switch {
+	case req.GitCommit != "" && req.GitDirty:
+		fmt.Printf("  commit:  %s, with uncommitted changes that are also built\n", req.GitCommit)
+	case req.GitCommit != "":
+		fmt.Printf("  commit:  %s\n", req.GitCommit)
+	}
+	fmt.Printf("  expires: %s\n", req.Expires.Local().Format(time.RFC1123))
+	if time.Now().After(req.Expires) {
+		fatal(logger, "Approval request has expired", nil, "request_id", id)
+	}
+
+	approver, err := callerIdentity(ctx)
+	if err != nil {
+		fatal(logger, "Could not get caller identity", err)
+	}
+	if approver == req.Requester {
+		fatal(logger, "A request must be approved by someone other than its requester", nil, "request_id", id, "requester", req.Requester)
+	}
+	// The approval is of the request as shown, whatever it is changed to.
+	a := &approval{ID: id, RequestDigest: digest, Approver: approver, Time: time.Now().UTC()}
+	if _, err := writeNewObject(ctx, approvals.Object(approvalObject(id)), a); err != nil {
+		if isPreconditionFailed(err) {
+			err = errors.New("already approved")
+		}
+		fatal(logger, "Could not approve request", err, "request_id", id)
+	}
+	fmt.Printf("Approved by %s.\n", approver)
+}
+
+// listApprovals lists the requests in bucket that are neither approved, in
+// the approvals bucket, nor expired.
+func listApprovals(ctx context.Context, bucket, approvals *cstorage.BucketHandle, w io.Writer) error {
+	approved := make(map[string]bool)
+	it := approvals.Objects(ctx, &cstorage.Query{Prefix: approvalPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(attrs.Name, approvalPrefix)
+		if id := strings.TrimSuffix(name, ".approved.json"); id != name {
+			approved[id] = true
+		}
+	}
+	var ids []string
+	it = bucket.Objects(ctx, &cstorage.Query{Prefix: approvalPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(attrs.Name, approvalPrefix)
+		if id := strings.TrimSuffix(name, ".json"); id != name {
+			ids = append(ids, id)
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tREQUESTER\tIMAGE\tTAGS\tEXPIRES")
+	for _, id := range ids {
+		if approved[id] {
+			continue
+		}
+		var req approvalRequest
+		if _, err := readObject(ctx, bucket.Object(requestObject(id)), &req); err != nil {
+			return err
+		}
+		if time.Now().After(req.Expires) {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", req.ID, req.Requester, req.Image, strings.Join(req.Tags, ","), req.Expires.Local().Format("15:04"))
+	}
+	return tw.Flush()
+}
+
+// isPreconditionFailed reports whether err is a 412 response from Cloud
+// Storage, as when writing an object that must not exist.
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == 412
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cstorage "cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+func TestCheckCannotApprove(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		code    int
+		resp    string
+		wantErr string
+	}{
+		{"reader", 0, `{"permissions": []}`, ""},
+		{"writer", 0, `{"permissions": ["storage.objects.create"]}`, "could approve your own request"},
+		{"missing", http.StatusNotFound, `{"error": {"code": 404, "message": "bucket not found"}}`, "does not exist"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/b/cdbuild-approvals-p/iam/testPermissions") {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				if tt.code != 0 {
+					w.WriteHeader(tt.code)
+				}
+				w.Write([]byte(tt.resp))
+			}))
+			defer ts.Close()
+			ctx := context.Background()
+			c, err := cstorage.NewClient(ctx, option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			err = checkCannotApprove(ctx, c.Bucket(approvalsBucket("p")))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fakeObjects is a stand-in for Cloud Storage that holds objects in memory,
+// ignoring their buckets.
+type fakeObjects struct {
+	objects map[string][]byte
+}
+
+func (fo *fakeObjects) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		// A multipart upload: the object's metadata, then its contents.
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		var meta struct {
+			Name string `json:"name"`
+		}
+		part, err := mr.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(&meta)
+		}
+		if err == nil {
+			part, err = mr.NextPart()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(part)
+		fo.objects[meta.Name] = b
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"name": %q, "bucket": "b", "size": "%d"}`, meta.Name, len(b))
+		return
+	}
+	// A read, of /bucket/object.
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	b, ok := fo.objects[parts[len(parts)-1]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(b)
+}
+
+func TestApprovalOfChangedRequest(t *testing.T) {
+	fo := &fakeObjects{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(fo)
+	defer ts.Close()
+	ctx := context.Background()
+	c, err := cstorage.NewClient(ctx, option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	obj := c.Bucket("cdbuild-p").Object(requestObject("1234"))
+
+	req := &approvalRequest{ID: "1234", Image: "gcr.io/p/app:v1", Tags: []string{"prod"}, Requester: "alice@example.com"}
+	written, err := writeNewObject(ctx, obj, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The approver reads the request as written.
+	var shown approvalRequest
+	digest, err := readObject(ctx, obj, &shown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &approval{ID: "1234", RequestDigest: digest, Approver: "bob@example.com"}
+	if err := req.checkApproval(a, written); err != nil {
+		t.Errorf("approval of the request as written: %v", err)
+	}
+
+	// The requester swaps the request for a harmless looking one, which
+	// the approver then reads and approves.
+	fake := *req
+	fake.Image, fake.Tags = "gcr.io/p/app:dev", []string{"dev"}
+	fo.objects[requestObject("1234")], _ = json.Marshal(fake)
+	if digest, err = readObject(ctx, obj, &shown); err != nil {
+		t.Fatal(err)
+	}
+	if shown.Image != fake.Image {
+		t.Fatalf("approver was shown %s, want the swapped %s", shown.Image, fake.Image)
+	}
+	a = &approval{ID: "1234", RequestDigest: digest, Approver: "bob@example.com"}
+	if err := req.checkApproval(a, written); err == nil || !strings.Contains(err.Error(), "changed after it was written") {
+		t.Errorf("approval of swapped request: got error %v, want request changed", err)
+	}
+
+	// Nor may the requester approve their own request.
+	a = &approval{ID: "1234", RequestDigest: written, Approver: req.Requester}
+	if err := req.checkApproval(a, written); err == nil || !strings.Contains(err.Error(), "by its requester") {
+		t.Errorf("approval by requester: got error %v, want approved by its requester", err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cstorage "cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+var (
+	artifactPaths stringsFlag
+	artifactsDir  = flag.String("artifacts-dir", "artifacts", "Local directory that build artifacts are downloaded to.")
+)
+
+func init() {
+	flag.Var(&artifactPaths, "artifacts", "Glob of files in the build workspace to retrieve after a successful build, e.g. 'dist/**'. May be repeated.")
+}
+
+// buildArtifacts returns the artifacts section of the build request, or nil
+// if no artifacts were requested. Artifacts are uploaded to prefix in bucket.
+func buildArtifacts(bucket, prefix string) *cloudbuild.Artifacts {
+	if len(artifactPaths) == 0 {
+		return nil
+	}
+	return &cloudbuild.Artifacts{
+		Objects: &cloudbuild.ArtifactObjects{
+			Location: "gs://" + bucket + "/" + prefix + "/",
+			Paths:    artifactPaths,
+		},
+	}
+}
+
+// manifestEntry is a line of the artifact manifest written by Cloud Build.
+type manifestEntry struct {
+	Location string `json:"location"`
+	FileHash []struct {
+		FileHash []fileHash `json:"file_hash"`
+	} `json:"file_hash"`
+}
+
+type fileHash struct {
+	Type  json.RawMessage `json:"type"` // Either the enum name or its number.
+	Value string          `json:"value"`
+}
+
+// hasher returns a hash.Hash for the hash's type, or nil if it is unknown.
+func (h fileHash) hasher() hash.Hash {
+	switch strings.Trim(string(h.Type), `"`) {
+	case "1", "SHA256":
+		return sha256.New()
+	case "2", "MD5":
+		return md5.New()
+	}
+	return nil
+}
+
+// downloadArtifacts reads the artifact manifest of build b and copies each
+// artifact it lists into dir, verifying the recorded checksums.
+func downloadArtifacts(ctx context.Context, c *cstorage.Client, b *cloudbuild.Build, dir string) error {
+	loc := b.Artifacts.Objects.Location
+	manifest := loc + "artifacts-" + b.Id + ".json"
+	if b.Results != nil && b.Results.ArtifactManifest != "" {
+		manifest = b.Results.ArtifactManifest
+	}
+	bucket, object, err := parseGCSURL(manifest)
+	if err != nil {
+		return err
+	}
+	r, err := c.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("could not read artifact manifest %s: %v", manifest, err)
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if len(strings.TrimSpace(s.Text())) == 0 {
+			continue
+		}
+		var e manifestEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return fmt.Errorf("could not parse artifact manifest: %v", err)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(e.Location, loc)))
+		// The manifest is written by the build, so its locations are not
+		// trusted to stay within dir.
+		if rel, err := filepath.Rel(dir, dst); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("artifact %s would be written outside %s", e.Location, dir)
+		}
+		if err := downloadArtifact(ctx, c, e, dst); err != nil {
+			return err
+		}
+		logger.Info("Downloaded artifact", "phase", "artifacts", "build_id", b.Id, "file", dst)
+	}
+	return s.Err()
+}
+
+func downloadArtifact(ctx context.Context, c *cstorage.Client, e manifestEntry, dst string) error {
+	bucket, object, err := parseGCSURL(e.Location)
+	if err != nil {
+		return err
+	}
+	var hashes []fileHash
+	for _, fh := range e.FileHash {
+		hashes = append(hashes, fh.FileHash...)
+	}
+
+	r, err := c.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(f)
+	hs := make([]hash.Hash, len(hashes))
+	for i, h := range hashes {
+		if hs[i] = h.hasher(); hs[i] != nil {
+			w = io.MultiWriter(w, hs[i])
+		}
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	verified := false
+	for i, h := range hashes {
+		if hs[i] == nil {
+			continue
+		}
+		if got := base64.StdEncoding.EncodeToString(hs[i].Sum(nil)); got != h.Value {
+			os.Remove(dst)
+			return fmt.Errorf("checksum mismatch for %s: got %s, manifest has %s", e.Location, got, h.Value)
+		}
+		verified = true
+	}
+	if !verified {
+		// An artifact that cannot be verified is not trusted.
+		os.Remove(dst)
+		var types []string
+		for _, h := range hashes {
+			types = append(types, strings.Trim(string(h.Type), `"`))
+		}
+		return fmt.Errorf("cannot verify %s: manifest has no checksum of a known type (has %q)", e.Location, types)
+	}
+	return nil
+}
+
+// parseGCSURL splits a gs://bucket/object URL into its bucket and object.
+func parseGCSURL(u string) (bucket, object string, err error) {
+	if !strings.HasPrefix(u, "gs://") {
+		return "", "", fmt.Errorf("not a Cloud Storage URL: %q", u)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u, "gs://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("not a Cloud Storage object URL: %q", u)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cstorage "cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	"google.golang.org/api/option"
+)
+
+func TestDownloadArtifact(t *testing.T) {
+	const data = "artifact contents"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(data))
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	c, err := cstorage.NewClient(ctx, option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sum := sha256.Sum256([]byte(data))
+	good := base64.StdEncoding.EncodeToString(sum[:])
+	for _, tt := range []struct {
+		name    string
+		hashes  string
+		wantErr string
+	}{
+		{"sha256", `[{"type": "SHA256", "value": "` + good + `"}]`, ""},
+		{"enum number", `[{"type": 1, "value": "` + good + `"}]`, ""},
+		{"mismatch", `[{"type": "SHA256", "value": "AAAA"}]`, "checksum mismatch"},
+		{"unknown type", `[{"type": "GO_MODULE_H1", "value": "xyz"}]`, "no checksum of a known type"},
+		{"no hashes", `[]`, "no checksum of a known type"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var e manifestEntry
+			line := `{"location": "gs://b/artifacts/dist/app", "file_hash": [{"file_hash": ` + tt.hashes + `}]}`
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(t.TempDir(), "app")
+			err := downloadArtifact(ctx, c, e, dst)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b, err := ioutil.ReadFile(dst); err != nil || string(b) != data {
+					t.Errorf("downloaded %q, %v; want %q", b, err, data)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if _, err := os.Stat(dst); !os.IsNotExist(err) {
+				t.Errorf("%s was kept", dst)
+			}
+		})
+	}
+}
+
+func TestDownloadArtifactsOutsideDir(t *testing.T) {
+	const manifest = `{"location": "gs://b/artifacts/../escaped", "file_hash": [{"file_hash": [{"type": "SHA256", "value": "AAAA"}]}]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/b/artifacts/artifacts-build1.json" {
+			w.Write([]byte(manifest + "\n"))
+			return
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	c, err := cstorage.NewClient(ctx, option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	root := t.TempDir()
+	b := &cloudbuild.Build{Id: "build1", Artifacts: &cloudbuild.Artifacts{Objects: &cloudbuild.ArtifactObjects{Location: "gs://b/artifacts/"}}}
+	err = downloadArtifacts(ctx, c, b, filepath.Join(root, "dist"))
+	if err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Fatalf("error = %v, want artifact outside the directory", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped")); !os.IsNotExist(err) {
+		t.Error("artifact was written outside the directory")
+	}
+}
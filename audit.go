@@ -0,0 +1,385 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	cstorage "cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+var (
+	auditSink      = flag.String("audit", "", "Where to append an audit record of each build: bucket (the staging bucket), file:PATH, or an http(s) URL to POST it to.")
+	auditRetention = flag.String("audit-retention", "365d", "How long audit records in the staging bucket are retained, e.g. 365d.")
+)
+
+// auditPrefix is the prefix of audit records in the staging bucket.
+const auditPrefix = "audit/"
+
+// auditRecord records who built what.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Caller    string    `json:"caller"` // Email of the authenticated identity.
+	Host      string    `json:"host"`
+	GitCommit string    `json:"gitCommit,omitempty"`
+	GitDirty  bool      `json:"gitDirty,omitempty"` // The work tree had uncommitted changes.
+	Flags     []string  `json:"flags"`
+	Project   string    `json:"project"`
+	Image     string    `json:"image"`
+	BuildID   string    `json:"buildId,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+	Promoted  []string  `json:"promoted,omitempty"`
+	Approval  string    `json:"approval,omitempty"` // ID of the approval request.
+	Approver  string    `json:"approver,omitempty"`
+	Result    string    `json:"result"` // SUCCESS, or why the build failed.
+}
+
+// audit writes audit records, or is nil if -audit is not set.
+var audit *auditor
+
+// auditor writes an audit record of each build to the -audit sink.
+type auditor struct {
+	c         *cstorage.Client
+	base      auditRecord // Fields that are the same for every build.
+	retention time.Duration
+
+	mu sync.Mutex // Serializes appends to a file.
+}
+
+// setupAudit sets audit according to the -audit flag. fs holds the flags to
+// record.
+func setupAudit(ctx context.Context, c *cstorage.Client, fs *flag.FlagSet) error {
+	if *auditSink == "" {
+		return nil
+	}
+	if *auditSink != "bucket" && !strings.HasPrefix(*auditSink, "file:") &&
+		!strings.HasPrefix(*auditSink, "http://") && !strings.HasPrefix(*auditSink, "https://") {
+		return fmt.Errorf("invalid -audit %q", *auditSink)
+	}
+	retention, err := parseAge(*auditRetention)
+	if err != nil {
+		return err
+	}
+	caller, err := callerIdentity(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get caller identity: %v", err)
+	}
+	host, _ := os.Hostname()
+	a := &auditor{
+		c:         c,
+		retention: retention,
+		base:      auditRecord{Caller: caller, Host: host},
+	}
+	a.base.GitCommit, a.base.GitDirty = gitHead()
+	fs.Visit(func(f *flag.Flag) {
+		v, _ := secretRedactor.redact(f.Value.String())
+		a.base.Flags = append(a.base.Flags, "-"+f.Name+"="+v)
+	})
+	audit = a
+	return nil
+}
+
+// gitHead returns the commit checked out in the current directory, if it is
+// in a git work tree, and whether the work tree has uncommitted changes.
+func gitHead() (commit string, dirty bool) {
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", false
+	}
+	commit = strings.TrimSpace(string(out))
+	out, err = exec.Command("git", "status", "--porcelain").Output()
+	return commit, err == nil && len(bytes.TrimSpace(out)) > 0
+}
+
+// callerIdentity returns the email address of the default credentials, from
+// Google's token info endpoint.
+func callerIdentity(ctx context.Context) (string, error) {
+	ts, err := google.DefaultTokenSource(ctx, storage.CloudPlatformScope)
+	if err != nil {
+		return "", err
+	}
+	tok, err := ts.Token()
+	if err != nil {
+		return "", err
+	}
+	// POST, so that the token is not in a URL that might be logged.
+	resp, err := http.PostForm("https://oauth2.googleapis.com/tokeninfo", url.Values{"access_token": {tok.AccessToken}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token info: %s", resp.Status)
+	}
+	var info struct {
+		Email string `json:"email"`
+		Sub   string `json:"sub"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	if info.Email != "" {
+		return info.Email, nil
+	}
+	if info.Sub != "" {
+		return "sub:" + info.Sub, nil
+	}
+	return "", errors.New("token info has no email")
+}
+
+// record writes the audit record of pb.
+func (a *auditor) record(ctx context.Context, pb *projectBuild) error {
+	r := a.base
+	r.Time = time.Now().UTC()
+	r.Project = pb.project
+	r.Image = pb.image
+	r.Result = "SUCCESS"
+	if b := pb.build; b != nil {
+		r.BuildID = b.Id
+		if b.Status == "SUCCESS" {
+			r.Digest, _ = builtDigest(b, pb.image)
+		}
+	}
+	if p := pb.sum.promotion; p != nil {
+		r.Promoted = p.tags
+	}
+	if a := pb.sum.approval; a != nil {
+		r.Approval, r.Approver = a.ID, a.Approver
+	}
+	if !pb.succeeded() {
+		switch {
+		case pb.err != nil:
+			r.Result, _ = secretRedactor.redact(pb.err.Error())
+		case pb.build != nil:
+			r.Result = pb.build.Status
+		default:
+			r.Result = "FAILURE"
+		}
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	switch sink := *auditSink; {
+	case sink == "bucket":
+		return a.writeObject(ctx, pb.bucket, r, b)
+	case strings.HasPrefix(sink, "file:"):
+		return a.appendFile(strings.TrimPrefix(sink, "file:"), b)
+	default:
+		return postAudit(ctx, sink, b)
+	}
+}
+
+// checkBucket checks, before anything is built, that audit records can be
+// written to bucket, which must have object retention enabled.
+func (a *auditor) checkBucket(ctx context.Context, bucket string) error {
+	if *auditSink != "bucket" {
+		return nil
+	}
+	attrs, err := a.c.Bucket(bucket).Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	if attrs.ObjectRetentionMode != "Enabled" {
+		return fmt.Errorf("bucket %s does not have object retention enabled, so audit records could not be locked; run cdbuild init -audit bucket", bucket)
+	}
+	return nil
+}
+
+// writeObject writes the record r, encoded as b, to a new object in bucket,
+// locked for -audit-retention.
+func (a *auditor) writeObject(ctx context.Context, bucket string, r auditRecord, b []byte) error {
+	name := fmt.Sprintf("%s%s-%s.json", auditPrefix, r.Time.Format("2006-01-02T15:04:05.000Z"), r.BuildID)
+	obj := a.c.Bucket(bucket).Object(name).If(cstorage.Conditions{DoesNotExist: true})
+	w := obj.NewWriter(ctx)
+	w.ContentType = "application/json"
+	w.Retention = &cstorage.ObjectRetention{Mode: "Locked", RetainUntil: r.Time.Add(a.retention)}
+	if _, err := w.Write(b); err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+	return w.Close()
+}
+
+func (a *auditor) appendFile(name string, b []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// postAudit posts the record b to url. It does not use the authenticated
+// client, so that Google credentials are not sent to another service.
+func postAudit(ctx context.Context, url string, b []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func auditCmd(args []string) {
+	fs := commandFlags("audit", "")
+	file := fs.String("file", "", "Read records from this local audit file, instead of the staging bucket.")
+	since := fs.String("since", "30d", "Show records from this long ago, e.g. 7d or 12h.")
+	image := fs.String("image", "", "Only show records for this image, e.g. gcr.io/my-project/app.")
+	caller := fs.String("caller", "", "Only show records of builds by this identity.")
+	asJSON := fs.Bool("json", false, "Print records as JSON lines.")
+	parseCommandFlags(fs, args)
+	age, err := parseAge(*since)
+	if err != nil {
+		fatal(logger, "Invalid -since", err)
+	}
+	from := time.Now().Add(-age).UTC()
+
+	ctx := context.Background()
+	var records []auditRecord
+	if *file != "" {
+		records, err = readAuditFile(*file)
+	} else {
+		records, err = readAuditBucket(ctx, "cdbuild-"+*projectID, from)
+	}
+	if err != nil {
+		fatal(logger, "Could not read audit records", err)
+	}
+	var out []auditRecord
+	for _, r := range records {
+		repo, _ := splitTag(r.Image)
+		if r.Time.Before(from) || (*image != "" && r.Image != *image && repo != *image) || (*caller != "" && r.Caller != *caller) {
+			continue
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range out {
+			enc.Encode(r)
+		}
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tCALLER\tIMAGE\tDIGEST\tBUILD\tCOMMIT\tAPPROVER\tRESULT")
+	for _, r := range out {
+		digest := r.Digest
+		if len(digest) > 19 {
+			digest = digest[:19]
+		}
+		commit := r.GitCommit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		if r.GitDirty {
+			commit += "+"
+		}
+		approver := r.Approver
+		if approver == "" {
+			approver = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format("2006-01-02 15:04"), r.Caller, r.Image, digest, r.BuildID, commit, approver, r.Result)
+	}
+	tw.Flush()
+}
+
+func readAuditFile(name string) ([]auditRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []auditRecord
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var r auditRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+		records = append(records, r)
+	}
+	return records, s.Err()
+}
+
+// readAuditBucket reads the audit records written to bucket since from.
+func readAuditBucket(ctx context.Context, bucket string, from time.Time) ([]auditRecord, error) {
+	hc, err := google.DefaultClient(ctx, storage.CloudPlatformScope)
+	if err != nil {
+		return nil, err
+	}
+	traceHTTP(hc)
+	c, err := cstorage.NewClient(ctx, option.WithHTTPClient(hc))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	// Record names start with their time, so skip older ones.
+	it := c.Bucket(bucket).Objects(ctx, &cstorage.Query{
+		Prefix:      auditPrefix,
+		StartOffset: auditPrefix + from.Format("2006-01-02T15:04:05"),
+	})
+	var records []auditRecord
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		r, err := c.Bucket(bucket).Object(attrs.Name).NewReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var rec auditRecord
+		err = json.NewDecoder(r).Decode(&rec)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", attrs.Name, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
@@ -0,0 +1,505 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	cstorage "cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+var substitutions substitutionsFlag
+
+func init() {
+	flag.Var(&substitutions, "substitution", "User-defined substitution for the build, as _KEY=value. May be repeated.")
+}
+
+// substitutionsFlag implements flag.Value for repeated -substitution flags.
+type substitutionsFlag map[string]string
+
+func (f *substitutionsFlag) String() string {
+	var kv []string
+	for k, v := range *f {
+		kv = append(kv, k+"="+v)
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, ",")
+}
+
+func (f *substitutionsFlag) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || !strings.HasPrefix(kv[0], "_") {
+		return fmt.Errorf("substitution %q must be of the form _KEY=value", v)
+	}
+	if *f == nil {
+		*f = make(substitutionsFlag)
+	}
+	(*f)[kv[0]] = kv[1]
+	return nil
+}
+
+// buildRequest returns the build of image that the flags describe, staged in
+// bucket. build are the steps that build the image, such as those from
+// buildSteps. Artifacts are uploaded under artifactsPrefix, and gc, if not
+// nil, is the Go cache of the test and build steps. The caller sets the
+// source.
+func buildRequest(image, bucket, artifactsPrefix string, build []*cloudbuild.BuildStep, gc *goCacheInfo) *cloudbuild.Build {
+	tests := testSteps()
+	steps := append(tests, build...)
+	if gc != nil {
+		steps = gc.wrapSteps(tests, build)
+	}
+	steps = append(steps, smokeSteps(image)...)
+	req := &cloudbuild.Build{
+		LogsBucket: bucket,
+		Steps:      steps,
+		Images:     []string{image},
+		Artifacts:  buildArtifacts(bucket, artifactsPrefix),
+		// Secrets are read by Cloud Build, not uploaded with the source.
+		AvailableSecrets: availableSecrets(),
+	}
+	if len(substitutions) > 0 {
+		req.Substitutions = make(map[string]string)
+		for k, v := range substitutions {
+			req.Substitutions[k] = v
+		}
+	}
+	return req
+}
+
+// projectBuild is the build of an image in one project. With -project
+// a,b,c the same source is built in each project concurrently, and cdbuild
+// compose builds each service's image at the same time.
+type projectBuild struct {
+	project    string
+	name       string // Image name in the project's registry.
+	label      string // Names the build when others run at the same time.
+	image      string
+	bucket     string // Staging bucket, which also holds the build logs.
+	dockerfile string // Checked against -policy.
+	steps      []*cloudbuild.BuildStep
+	src        *source
+	log        *slog.Logger
+	rc         *registryClient
+
+	sum   *summary
+	build *cloudbuild.Build
+	err   error
+}
+
+// newProjectBuild returns the build of the image imageName in project from
+// src, with the steps that the flags describe. label prefixes streamed log
+// lines and the summary if it is not empty.
+func newProjectBuild(project, imageName, label string, src *source) *projectBuild {
+	image := "gcr.io/" + project + "/" + imageName
+	return &projectBuild{
+		project:    project,
+		name:       imageName,
+		label:      label,
+		image:      image,
+		bucket:     "cdbuild-" + project,
+		dockerfile: "Dockerfile",
+		steps:      buildSteps(image),
+		src:        src,
+		log:        logger.With("project", project, "image", image),
+		sum:        &summary{},
+	}
+}
+
+// runBuilds runs builds concurrently, then prints their summaries and returns
+// the number that failed.
+func runBuilds(ctx context.Context, hc *http.Client, c *cstorage.Client, api *cloudbuild.Service, builds []*projectBuild) int {
+	var wg sync.WaitGroup
+	for _, pb := range builds {
+		wg.Add(1)
+		go func(pb *projectBuild) {
+			defer wg.Done()
+			pb.err = pb.run(ctx, hc, c, api)
+			if audit == nil {
+				return
+			}
+			if err := audit.record(ctx, pb); err != nil {
+				err = pb.fail(pb.log, "Could not write audit record", err, "phase", "audit")
+				if pb.err == nil {
+					pb.err = err
+				}
+			}
+		}(pb)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, pb := range builds {
+		if pb.label != "" {
+			fmt.Printf("== %s ==\n", pb.label)
+		}
+		pb.sum.print(os.Stdout)
+		if !pb.succeeded() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// succeeded reports whether the image was built, passed its checks and was
+// mirrored.
+func (pb *projectBuild) succeeded() bool {
+	return pb.err == nil && pb.build != nil && pb.build.Status == "SUCCESS" && !pb.sum.specFailed() &&
+		!(pb.sum.scanFailed() && *scanAction == "fail") && pb.sum.failedMirrors() == 0
+}
+
+// registry returns a client for the image's registry, creating it on first
+// use.
+func (pb *projectBuild) registry(ctx context.Context) (*registryClient, error) {
+	if pb.rc == nil {
+		ts, err := google.DefaultTokenSource(ctx, storage.CloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+		pb.rc = newRegistryClient(ts)
+	}
+	return pb.rc, nil
+}
+
+// scan waits for the vulnerability scan of the image built by b.
+func (pb *projectBuild) scan(ctx context.Context, hc *http.Client, b *cloudbuild.Build, allow map[string]bool) (*scanResult, error) {
+	digest, err := builtDigest(b, pb.image)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := newContainerAnalysis(ctx, hc)
+	if err != nil {
+		return nil, err
+	}
+	return scanImageDigest(ctx, ca, pb.project, pb.image, digest, allow)
+}
+
+// fail logs msg and err at error level and returns them as a single error.
+func (pb *projectBuild) fail(l *slog.Logger, msg string, err error, args ...interface{}) error {
+	if err != nil {
+		l.Error(msg, append(args, "error", err.Error())...)
+		return fmt.Errorf("%s: %v", msg, err)
+	}
+	l.Error(msg, args...)
+	return fmt.Errorf("%s", msg)
+}
+
+// run uploads the build's source to the project's staging bucket, builds it,
+// and waits for the build to finish.
+func (pb *projectBuild) run(ctx context.Context, hc *http.Client, c *cstorage.Client, api *cloudbuild.Service) error {
+	l := pb.log
+	artifactsPrefix := fmt.Sprintf("artifacts/%s-%s", pb.name, uuid.Must(uuid.NewV4()))
+	project := attribute.String("project", pb.project)
+
+	_, ph := tel.startPhase(ctx, "setup_bucket", project, attribute.String("bucket", pb.bucket))
+	err := setupBucket(ctx, hc, pb.project, pb.bucket)
+	ph.end(err)
+	if err != nil {
+		if gerr, ok := err.(*googleapi.Error); ok {
+			if gerr.Code == 403 {
+				// HACK(cbro): storage returns a 403 if billing is not enabled.
+				return pb.fail(l, "Could not set up Cloud Storage bucket. It's possible billing is not enabled.", err, "phase", "setup_bucket", "bucket", pb.bucket)
+			}
+		}
+		return pb.fail(l, "Could not set up buckets", err, "phase", "setup_bucket", "bucket", pb.bucket)
+	}
+	if audit != nil {
+		if err := audit.checkBucket(ctx, pb.bucket); err != nil {
+			return pb.fail(l, "Could not set up audit", err, "phase", "setup_bucket", "bucket", pb.bucket)
+		}
+	}
+
+	if *goCache {
+		pb.sum.goCache, err = lookupGoCache(ctx, c, pb.bucket)
+		if err != nil {
+			return pb.fail(l, "Could not look up Go cache", err, "phase", "go_cache")
+		}
+	}
+	req := buildRequest(pb.image, pb.bucket, artifactsPrefix, pb.steps, pb.sum.goCache)
+	// Tag the build with its source so that cdbuild stats can tell builds of
+	// the same source.
+	req.Tags = append(req.Tags, sourceTagPrefix+pb.src.hash)
+
+	if *policyFile != "" {
+		if err := enforcePolicy(*policyFile, pb.dockerfile, pb.project, req); err != nil {
+			return pb.fail(l, "Policy check failed", err, "phase", "policy")
+		}
+	}
+
+	var spec *imageSpec
+	var saved *savedTag
+	baseline, baseSize := "", int64(-1)
+	if *imageSpecFile != "" {
+		if spec, err = readImageSpec(*imageSpecFile); err != nil {
+			return pb.fail(l, "Could not read image spec", err, "phase", "image_spec")
+		}
+		rc, err := pb.registry(ctx)
+		if err != nil {
+			return pb.fail(l, "Could not get token source", err, "phase", "image_spec")
+		}
+		if saved, err = saveTag(ctx, rc, pb.image); err != nil {
+			return pb.fail(l, "Could not read image tag", err, "phase", "image_spec")
+		}
+		if spec.MaxSizeIncrease != "" {
+			if baseline, baseSize, err = spec.baselineSize(ctx, rc, pb.image); err != nil {
+				return pb.fail(l, "Could not get size of baseline image", err, "phase", "image_spec")
+			}
+			l.Debug("Baseline image", "phase", "image_spec", "baseline", baseline, "bytes", baseSize)
+		}
+	}
+
+	var allow map[string]bool
+	if *scanImage {
+		if allow, err = checkScanFlags(); err != nil {
+			return pb.fail(l, "Invalid scan options", err, "phase", "scan")
+		}
+		if err := checkScanningEnabled(ctx, hc, pb.project); err != nil {
+			return pb.fail(l, "Cannot scan image", err, "phase", "scan")
+		}
+	}
+
+	// Nothing is uploaded or submitted until protected tags are approved.
+	if tags := protectedTags(pb.image); len(tags) > 0 {
+		_, ph = tel.startPhase(ctx, "approval", project)
+		pb.sum.approval, err = pb.awaitApproval(ctx, c, tags)
+		ph.end(err)
+		if err != nil {
+			return pb.fail(l, "Build was not approved", err, "phase", "approval")
+		}
+		l.Info("Build approved", "phase", "approval", "request_id", pb.sum.approval.ID, "approver", pb.sum.approval.Approver)
+		// Record the approval in the build, and so in its provenance.
+		if req.Options == nil {
+			req.Options = &cloudbuild.BuildOptions{}
+		}
+		req.Options.Env = append(req.Options.Env,
+			"CDBUILD_APPROVAL_ID="+pb.sum.approval.ID,
+			"CDBUILD_APPROVED_BY="+pb.sum.approval.Approver)
+	}
+
+	var blf *buildLog
+	if *logFile != "" {
+		if blf, err = createBuildLog(pb.label); err != nil {
+			return pb.fail(l, "Could not create log file", err, "phase", "log_file")
+		}
+		defer func() {
+			if err := blf.close(); err != nil {
+				l.Warn("Could not write log file", "phase", "log_file", "error", err.Error())
+			}
+		}()
+	}
+
+	l.Info("Pushing code", "phase", "upload", "bucket", pb.bucket)
+
+	_, ph = tel.startPhase(ctx, "upload", project)
+	buildObject, size, err := pb.src.acquire(ctx, c, pb.bucket)
+	ph.end(err, attribute.Int64("context.bytes", size))
+	// The source is released however the build ends. Failing to delete it
+	// does not fail the build, as the bucket's lifecycle rule deletes it
+	// later.
+	defer func() {
+		_, ph := tel.startPhase(ctx, "cleanup", project)
+		err := pb.src.release(ctx, c, pb.bucket)
+		ph.end(err)
+		if err != nil {
+			l.Warn("Could not delete source tar.gz", "phase", "cleanup", "error", err.Error())
+			return
+		}
+		l.Info("Cleaned up.", "phase", "cleanup")
+	}()
+	if err != nil {
+		return pb.fail(l, "Could not upload source", err, "phase", "upload")
+	}
+	l.Debug("Uploaded source", "phase", "upload", "object", fmt.Sprintf("gs://%s/%s", pb.bucket, buildObject), "bytes", size)
+	req.Source = &cloudbuild.Source{
+		StorageSource: &cloudbuild.StorageSource{
+			Bucket: pb.bucket,
+			Object: buildObject,
+		},
+	}
+	l.Debug("Build request", "phase", "submit", "request", jsonValue{req})
+	propagateTrace(ctx, req)
+
+	var b *cloudbuild.Build
+	for attempt := 1; ; attempt++ {
+		_, ph = tel.startPhase(ctx, "submit", project, attribute.Int("attempt", attempt))
+		remoteID, err := createBuild(ctx, api, pb.project, req)
+		ph.end(err, attribute.String("build.id", remoteID))
+		if err != nil {
+			if gerr, ok := err.(*googleapi.Error); ok {
+				if gerr.Code == 404 {
+					// HACK(cbro): the API does not return a good error if the API is not enabled.
+					return pb.fail(l, "Could not create build. It's likely the Cloud Container Builder API is not enabled.", err,
+						"phase", "submit",
+						"enable_url", "https://console.cloud.google.com/apis/api/cloudbuild.googleapis.com/overview?project="+pb.project)
+				}
+			}
+			return pb.fail(l, "Could not create build", err, "phase", "submit")
+		}
+		blog := l.With("build_id", remoteID)
+
+		blog.Info("Build submitted", "phase", "submit", "attempt", attempt,
+			"logs", fmt.Sprintf("https://console.cloud.google.com/m/cloudstorage/b/%s/o/log-%s.txt", pb.bucket, remoteID))
+
+		var tail *logTailer
+		show := *runTests
+		if blf != nil {
+			blf.startBuild(remoteID, attempt)
+		}
+		if show || blf != nil {
+			pb.sum.tests = newTestReport()
+			lr := newLogRedactor()
+			tail = newLogTailer(c, pb.bucket, remoteID, func(line string) {
+				line, n := lr.redact(line)
+				pb.sum.redactions += n
+				if blf != nil {
+					blf.writeLine(line)
+				}
+				pb.sum.tests.addLine(line)
+				if !show {
+					return
+				}
+				out := line
+				if colorLogs {
+					out = colorStep(line)
+				}
+				if pb.label != "" {
+					fmt.Printf("[%s] %s\n", pb.label, out)
+				} else {
+					fmt.Println(out)
+				}
+			})
+		}
+		b, err = waitForBuild(ctx, api, pb.project, remoteID, tail)
+		if err != nil {
+			return pb.fail(blog, "Could not get build status", err, "phase", "run")
+		}
+		pb.build = b
+		blog.Info("Build finished", "phase", "run", "status", b.Status)
+		tel.recordRemotePhases(ctx, b)
+
+		reason, transient := transientFailure(b)
+		if !transient || attempt > *retries {
+			break
+		}
+		blog.Warn("Build failed for a transient reason; retrying", "phase", "run",
+			"reason", reason, "delay", retryDelay.String(), "next_attempt", attempt+1, "max_attempts", *retries+1)
+		time.Sleep(*retryDelay)
+	}
+	l = l.With("build_id", b.Id)
+	if *smokeTest {
+		pb.sum.smoke = stepStatus(b, smokeStepID)
+	}
+	if gc := pb.sum.goCache; gc != nil && b.Status == "SUCCESS" {
+		if err := gc.stat(ctx, c); err != nil {
+			l.Warn("Could not get Go cache size", "phase", "go_cache", "error", err.Error())
+		}
+	}
+	if spec != nil && b.Status == "SUCCESS" {
+		rc, err := pb.registry(ctx)
+		if err != nil {
+			return pb.fail(l, "Could not get token source", err, "phase", "image_spec")
+		}
+		_, ph = tel.startPhase(ctx, "image_spec", project)
+		pb.sum.spec, err = checkImageSpec(ctx, rc, spec, b, pb.image, baseline, baseSize)
+		ph.end(err)
+		if err != nil {
+			return pb.fail(l, "Could not check image spec", err, "phase", "image_spec")
+		}
+		for _, v := range pb.sum.spec.violations {
+			l.Warn("Image spec violation", "phase", "image_spec", "violation", v)
+		}
+		if pb.sum.specFailed() {
+			if pb.sum.spec.restored, err = saved.restore(ctx, rc); err != nil {
+				return pb.fail(l, "Could not restore image tag", err, "phase", "image_spec")
+			}
+			l.Warn("Image does not meet its spec", "phase", "image_spec", "tag", pb.sum.spec.restored)
+		}
+	}
+	if *scanImage && b.Status == "SUCCESS" {
+		_, ph = tel.startPhase(ctx, "scan", project)
+		pb.sum.scan, err = pb.scan(ctx, hc, b, allow)
+		ph.end(err)
+		if err != nil {
+			return pb.fail(l, "Could not scan image", err, "phase", "scan")
+		}
+		for _, f := range pb.sum.scan.findings {
+			l.Warn("Vulnerability", "phase", "scan", "id", f.id, "severity", f.severity, "package", f.pkg)
+		}
+	}
+	// Images that do not meet the spec are not mirrored.
+	if b.Status == "SUCCESS" && len(mirrors) > 0 && !pb.sum.specFailed() {
+		rc, err := pb.registry(ctx)
+		if err != nil {
+			return pb.fail(l, "Could not get token source", err, "phase", "mirror")
+		}
+		_, ph = tel.startPhase(ctx, "mirror", project)
+		pb.sum.mirrors, err = mirrorImage(ctx, rc, b, pb.image)
+		ph.end(err)
+		if err != nil {
+			return pb.fail(l, "Could not mirror image", err, "phase", "mirror")
+		}
+	}
+
+	if b.Status == "SUCCESS" && len(promoteTags) > 0 {
+		pb.sum.promotion = &promotion{}
+		switch {
+		case pb.sum.specFailed():
+			pb.sum.promotion.withheld = "the image does not meet its spec"
+		case pb.sum.scanFailed():
+			pb.sum.promotion.withheld = fmt.Sprintf("the scan found %d vulnerabilities at or above %s", len(pb.sum.scan.findings), *scanSeverity)
+		default:
+			rc, err := pb.registry(ctx)
+			if err != nil {
+				return pb.fail(l, "Could not get token source", err, "phase", "promote")
+			}
+			_, ph = tel.startPhase(ctx, "promote", project)
+			pb.sum.promotion.tags, err = promoteImage(ctx, rc, b, pb.image, promoteTags)
+			ph.end(err)
+			if err != nil {
+				return pb.fail(l, "Could not promote image", err, "phase", "promote")
+			}
+		}
+		if w := pb.sum.promotion.withheld; w != "" {
+			l.Warn("Promotion withheld", "phase", "promote", "reason", w)
+		}
+	}
+
+	if b.Status == "SUCCESS" && b.Artifacts != nil {
+		dir := *artifactsDir
+		if pb.label != "" {
+			dir = filepath.Join(dir, filepath.FromSlash(pb.label))
+		}
+		if err := downloadArtifacts(ctx, c, b, dir); err != nil {
+			return pb.fail(l, "Could not download artifacts", err, "phase", "artifacts")
+		}
+	}
+	if pb.sum.specFailed() {
+		return pb.fail(l, fmt.Sprintf("Image does not meet spec: %d violations", len(pb.sum.spec.violations)), nil, "phase", "image_spec")
+	}
+	if pb.sum.scanFailed() && *scanAction == "fail" {
+		return pb.fail(l, fmt.Sprintf("Vulnerability scan failed: %d vulnerabilities at or above %s", len(pb.sum.scan.findings), *scanSeverity), nil, "phase", "scan")
+	}
+	if n := pb.sum.failedMirrors(); n > 0 {
+		return pb.fail(l, fmt.Sprintf("Could not mirror image to %d of %d destinations", n, len(pb.sum.mirrors)), nil, "phase", "mirror")
+	}
+	return nil
+}
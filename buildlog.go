@@ -0,0 +1,125 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+var (
+	logFile        = flag.String("log-file", "", "File to save the build log to. With several builds, the name of each build is added before the extension.")
+	buildLogFormat = flag.String("build-log-format", "prefixed", "Format of -log-file: raw, prefixed (each line with its step and the time cdbuild read it, to within a second), or json.")
+)
+
+// colorLogs is whether streamed build log lines have their step prefix
+// colored.
+var colorLogs = term.IsTerminal(int(os.Stdout.Fd())) && os.Getenv("NO_COLOR") == ""
+
+// stepColors are the ANSI colors of step prefixes, chosen by step ID.
+var stepColors = []string{"36", "33", "35", "32", "34", "91", "96", "93"}
+
+// buildLog writes the lines of a build log to a file in the -build-log-format
+// format.
+type buildLog struct {
+	f       *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	buildID string
+}
+
+// buildLogRecord is a line of a build log in the json format. ReadTime is
+// when cdbuild read the line, which it does about once a second, not when
+// the step wrote it.
+type buildLogRecord struct {
+	ReadTime time.Time `json:"read_time"`
+	BuildID  string    `json:"build_id"`
+	Step     string    `json:"step,omitempty"`
+	Text     string    `json:"text"`
+}
+
+// createBuildLog creates the -log-file for the build with the given label,
+// which may be empty.
+func createBuildLog(label string) (*buildLog, error) {
+	switch *buildLogFormat {
+	case "raw", "prefixed", "json":
+	default:
+		return nil, fmt.Errorf("unknown build log format %q", *buildLogFormat)
+	}
+	name := *logFile
+	if label != "" {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "-" + strings.Replace(label, "/", "-", -1) + ext
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	l := &buildLog{f: f, w: bufio.NewWriter(f)}
+	l.enc = json.NewEncoder(l.w)
+	return l, nil
+}
+
+// startBuild marks the start of the log of a build attempt.
+func (l *buildLog) startBuild(id string, attempt int) {
+	if l.buildID != "" && *buildLogFormat == "prefixed" {
+		fmt.Fprintf(l.w, "%s retrying as build %s (attempt %d)\n", time.Now().UTC().Format(time.RFC3339), id, attempt)
+	}
+	l.buildID = id
+}
+
+// writeLine writes a line of the build log, read from Cloud Build at the
+// current time.
+func (l *buildLog) writeLine(line string) {
+	now := time.Now().UTC()
+	switch *buildLogFormat {
+	case "raw":
+		fmt.Fprintln(l.w, line)
+	case "prefixed":
+		step, text, ok := splitStepLine(line)
+		if !ok {
+			fmt.Fprintf(l.w, "%s %s\n", now.Format(time.RFC3339), line)
+			return
+		}
+		fmt.Fprintf(l.w, "%s [%s] %s\n", now.Format(time.RFC3339), step, text)
+	case "json":
+		r := buildLogRecord{ReadTime: now, BuildID: l.buildID, Text: line}
+		if step, text, ok := splitStepLine(line); ok {
+			r.Step, r.Text = step, text
+		}
+		l.enc.Encode(r)
+	}
+}
+
+func (l *buildLog) close() error {
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// colorStep returns line with its step prefix, if it has one, colored by
+// step ID.
+func colorStep(line string) string {
+	step, text, ok := splitStepLine(line)
+	if !ok {
+		return line
+	}
+	h := fnv.New32a()
+	h.Write([]byte(step))
+	c := stepColors[h.Sum32()%uint32(len(stepColors))]
+	prefix := line[:len(line)-len(text)]
+	return "\x1b[" + c + "m" + prefix + "\x1b[0m" + text
+}
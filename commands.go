@@ -0,0 +1,165 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// A command is a cdbuild subcommand, such as "cdbuild usage". Without a
+// subcommand, cdbuild builds an image.
+type command struct {
+	run   func(args []string)
+	short string
+}
+
+var commands = map[string]command{
+	"approve":  {approveCmd, "Approve a build of a protected tag, or list pending requests."},
+	"audit":    {auditCmd, "Show the audit trail of who built which images."},
+	"compose":  {composeCmd, "Build the images of the services in a docker-compose file."},
+	"convert":  {convertCmd, "Convert between cdbuild config and a native cloudbuild.yaml."},
+	"init":     {initCmd, "Set up a project for cdbuild, showing the changes first."},
+	"stats":    {statsCmd, "Report step timings, success rates and flaky steps for an image."},
+	"top":      {topCmd, "Show active builds in an interactive terminal dashboard."},
+	"triggers": {triggersCmd, "Apply build triggers declared in YAML, or export existing ones."},
+	"usage":    {usageCmd, "Report build minutes and estimated cost."},
+}
+
+// runCommand runs the subcommand named by args[0], if there is one, and
+// reports whether it did.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+	cmd.run(args[1:])
+	return true
+}
+
+// printCommands lists the subcommands on stderr.
+func printCommands() {
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", n, commands[n].short)
+	}
+}
+
+// commandFlags returns a flag set for the named subcommand, with the -project
+// and logging flags already defined.
+func commandFlags(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s %s:\n", os.Args[0], name)
+		if args != "" {
+			fmt.Fprintf(os.Stderr, "  %s %s [flags] %s\n", os.Args[0], name, args)
+		}
+		fs.PrintDefaults()
+	}
+	fs.StringVar(projectID, "project", "", "Project ID. Required.")
+	fs.Var(&verbosity, "v", "Log more detail. Repeat (-v -v) to also trace HTTP requests.")
+	fs.BoolVar(quiet, "q", false, "Only log warnings and errors.")
+	fs.StringVar(logFormat, "log-format", "text", "Log format: text or json.")
+	return fs
+}
+
+// parseCommandFlags parses the flags of a subcommand, sets up logging and
+// checks that a project was given.
+func parseCommandFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *projectID == "" {
+		logger.Error("Missing 'project' flag.")
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// newCloudBuild returns an authenticated HTTP client and a Cloud Build client
+// that uses it.
+func newCloudBuild(ctx context.Context) (*http.Client, *cloudbuild.Service, error) {
+	hc, err := google.DefaultClient(ctx, storage.CloudPlatformScope)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get authenticated HTTP client: %v", err)
+	}
+	traceHTTP(hc)
+	api, err := cloudbuild.New(hc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get cloudbuild client: %v", err)
+	}
+	return hc, api, nil
+}
+
+// listBuilds calls fn for each build in the project created at or after
+// since, most recent first. filter is an additional Cloud Build list filter,
+// which may be empty.
+func listBuilds(ctx context.Context, api *cloudbuild.Service, since time.Time, filter string, fn func(*cloudbuild.Build)) error {
+	f := fmt.Sprintf("create_time>=%q", since.UTC().Format(time.RFC3339))
+	if filter != "" {
+		f += " AND " + filter
+	}
+	return api.Projects.Builds.List(*projectID).Filter(f).PageSize(500).Pages(ctx, func(resp *cloudbuild.ListBuildsResponse) error {
+		for _, b := range resp.Builds {
+			fn(b)
+		}
+		return nil
+	})
+}
+
+// parseAge parses a duration such as "30d" or "12h". In addition to the
+// units accepted by time.ParseDuration, "d" means days.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// buildDuration returns how long build b ran for, or false if it has not
+// started and finished.
+func buildDuration(b *cloudbuild.Build) (time.Duration, bool) {
+	return timeSpan(b.StartTime, b.FinishTime)
+}
+
+// timeSpan returns the duration between two RFC 3339 timestamps, or false if
+// either is missing or invalid.
+func timeSpan(start, end string) (time.Duration, bool) {
+	s, err := time.Parse(time.RFC3339Nano, start)
+	if err != nil {
+		return 0, false
+	}
+	e, err := time.Parse(time.RFC3339Nano, end)
+	if err != nil {
+		return 0, false
+	}
+	return e.Sub(s), true
+}
@@ -0,0 +1,313 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cstorage "cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	"google.golang.org/api/option"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// composeFile is the part of a docker-compose file that cdbuild compose
+// reads. Other keys are ignored.
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+}
+
+type composeService struct {
+	Image string        `yaml:"image"`
+	Build *composeBuild `yaml:"build"`
+}
+
+// composeBuild is a service's build section, which is either the path of the
+// build context or a mapping.
+type composeBuild struct {
+	Context    string
+	Dockerfile string
+	Args       map[string]string
+	Target     string
+}
+
+func (b *composeBuild) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&b.Context); err == nil {
+		return nil
+	}
+	var long struct {
+		Context    string      `yaml:"context"`
+		Dockerfile string      `yaml:"dockerfile"`
+		Args       interface{} `yaml:"args"`
+		Target     string      `yaml:"target"`
+	}
+	if err := unmarshal(&long); err != nil {
+		return err
+	}
+	b.Context, b.Dockerfile, b.Target = long.Context, long.Dockerfile, long.Target
+	b.Args = make(map[string]string)
+	// Args are a mapping or a list of KEY=value. As with docker compose, an
+	// arg without a value is taken from the environment, and left out if it
+	// is not set there.
+	set := func(k string, v interface{}) {
+		if v != nil {
+			b.Args[k] = fmt.Sprint(v)
+		} else if ev, ok := os.LookupEnv(k); ok {
+			b.Args[k] = ev
+		}
+	}
+	switch args := long.Args.(type) {
+	case nil:
+	case map[interface{}]interface{}:
+		for k, v := range args {
+			set(fmt.Sprint(k), v)
+		}
+	case []interface{}:
+		for _, a := range args {
+			kv := strings.SplitN(fmt.Sprint(a), "=", 2)
+			if len(kv) == 2 {
+				set(kv[0], kv[1])
+			} else {
+				set(kv[0], nil)
+			}
+		}
+	default:
+		return fmt.Errorf("build args must be a mapping or a list")
+	}
+	return nil
+}
+
+// composeTarget is a service to build.
+type composeTarget struct {
+	service string
+	name    string // Image name in the project's registry.
+	build   *composeBuild
+	dir     string // Absolute path of the build context.
+	root    string // Directory packaged for the build; dir or a parent of it.
+}
+
+func composeCmd(args []string) {
+	fs := flag.NewFlagSet("compose", flag.ExitOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	file := fs.String("f", "docker-compose.yml", "Compose file to read services from.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s compose:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s compose [build flags] [-f docker-compose.yml] [service...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := loadConfig(fs, configFile, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	parseCommandFlags(fs, args)
+	if len(extraContexts) > 0 {
+		logger.Error("Named build contexts cannot be used with compose.")
+		os.Exit(2)
+	}
+	targets, err := readCompose(*file, fs.Args())
+	if err != nil {
+		fatal(logger, "Could not read compose file", err)
+	}
+	if len(targets) == 0 {
+		fatal(logger, "No services to build in "+*file, nil)
+	}
+	projects, err := splitProjects(*projectID)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	if err := setupTelemetry(ctx); err != nil {
+		fatal(logger, "Could not set up telemetry", err)
+	}
+	ctx, tel.root = tel.startPhase(ctx, "cdbuild", attribute.String("compose", *file))
+
+	hc, api, err := newCloudBuild(ctx)
+	if err != nil {
+		fatal(logger, "Could not create client", err)
+	}
+	if err := setupRedaction(ctx, hc); err != nil {
+		fatal(logger, "Could not set up redaction", err)
+	}
+	c, err := cstorage.NewClient(ctx, option.WithHTTPClient(hc))
+	if err != nil {
+		fatal(logger, "Could not make Cloud storage client", err)
+	}
+	defer c.Close()
+	if err := setupAudit(ctx, c, fs); err != nil {
+		fatal(logger, "Could not set up audit", err)
+	}
+
+	// Services whose contexts overlap share a package of the outermost one.
+	srcs := make(map[string]*source)
+	for _, t := range targets {
+		if srcs[t.root] != nil {
+			continue
+		}
+		_, ph := tel.startPhase(ctx, "package", attribute.String("context", t.root))
+		src, err := packageSource(filepath.Base(t.root), []buildContext{{dir: t.root}})
+		ph.end(err)
+		if err != nil {
+			fatal(logger, "Could not package source", err, "phase", "package", "context", t.root)
+		}
+		defer src.close()
+		srcs[t.root] = src
+		logger.Debug("Packaged build context", "phase", "package", "context", t.root)
+	}
+
+	var builds []*projectBuild
+	for _, p := range projects {
+		for _, t := range targets {
+			label := t.service
+			if len(projects) > 1 {
+				label = p + "/" + t.service
+			}
+			pb := newProjectBuild(p, t.name, label, srcs[t.root])
+			pb.steps = composeSteps(pb.image, t)
+			pb.dockerfile = filepath.Join(t.dir, t.dockerfile())
+			pb.log = pb.log.With("service", t.service)
+			builds = append(builds, pb)
+		}
+	}
+	failed := runBuilds(ctx, hc, c, api, builds)
+	if failed > 0 {
+		fatal(logger, fmt.Sprintf("Build failed for %d of %d images", failed, len(builds)), nil)
+	}
+	tel.root.end(nil)
+	shutdownTelemetry()
+}
+
+// readCompose returns the services in the compose file name that have a build
+// section, or only the named services if there are any.
+func readCompose(name string, services []string) ([]*composeTarget, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var cf composeFile
+	if err := yaml.Unmarshal(b, &cf); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", name, err)
+	}
+	if len(services) == 0 {
+		for s, svc := range cf.Services {
+			if svc.Build != nil {
+				services = append(services, s)
+			}
+		}
+		sort.Strings(services)
+	}
+	base, err := filepath.Abs(filepath.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*composeTarget
+	names := make(map[string]string)
+	for _, s := range services {
+		svc, ok := cf.Services[s]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("no service %q in %s", s, name)
+		case svc.Build == nil:
+			return nil, fmt.Errorf("service %q has no build section", s)
+		case strings.Contains(svc.Build.Context, "://") || strings.HasPrefix(svc.Build.Context, "git@"):
+			return nil, fmt.Errorf("service %q: remote build contexts are not supported", s)
+		}
+		n := composeImageName(s, svc.Image)
+		if other, ok := names[n]; ok {
+			return nil, fmt.Errorf("services %q and %q both build image %s", other, s, n)
+		}
+		names[n] = s
+		dir := svc.Build.Context
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(base, dir)
+		}
+		targets = append(targets, &composeTarget{
+			service: s,
+			name:    n,
+			build:   svc.Build,
+			dir:     filepath.Clean(dir),
+		})
+	}
+
+	// Package each context inside another, or the same as another, with the
+	// outermost one, so that it is only uploaded once. Contexts are packaged
+	// in full, so the outer context's .dockerignore cannot exclude an inner
+	// one; each service's build applies its own context's .dockerignore.
+	var dirs []string
+	for _, t := range targets {
+		dirs = append(dirs, t.dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) < len(dirs[j]) })
+	for _, t := range targets {
+		for _, d := range dirs {
+			if rel, err := filepath.Rel(d, t.dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				t.root = d
+				break
+			}
+		}
+	}
+	return targets, nil
+}
+
+// composeImageName returns the name in the project's registry of the image
+// for service. It is the last element of image, such as api:1.2 for
+// example.com/team/api:1.2, or the service name if image is empty.
+func composeImageName(service, image string) string {
+	if image == "" {
+		return service
+	}
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	return path.Base(image)
+}
+
+func (t *composeTarget) dockerfile() string {
+	if t.build.Dockerfile == "" {
+		return "Dockerfile"
+	}
+	return t.build.Dockerfile
+}
+
+// composeSteps returns the steps that build image for t, from t's context
+// within the packaged source.
+func composeSteps(image string, t *composeTarget) []*cloudbuild.BuildStep {
+	args := []string{"buildx", "build", "-t", image, "-f", t.dockerfile()}
+	var keys []string
+	for k := range t.build.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// Escape $ so that Cloud Build does not treat it as a substitution.
+		args = append(args, "--build-arg", k+"="+strings.Replace(t.build.Args[k], "$", "$$", -1))
+	}
+	if t.build.Target != "" {
+		args = append(args, "--target", t.build.Target)
+	}
+	step := &cloudbuild.BuildStep{
+		Name: "gcr.io/cloud-builders/docker",
+		Args: append(args, "."),
+		Env:  []string{"DOCKER_BUILDKIT=1"},
+	}
+	if rel, _ := filepath.Rel(t.root, t.dir); rel != "." {
+		step.Dir = filepath.ToSlash(rel)
+	}
+	addBuildSecrets(step)
+	return []*cloudbuild.BuildStep{step}
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestComposeNestedContexts(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"docker-compose.yml": `services:
+  web:
+    build: .
+  api:
+    build:
+      context: ./api
+      args: [VERSION=1.2]
+  db:
+    image: postgres
+`,
+		// The root ignores the api context, which has rules of its own.
+		".dockerignore":     "api\n",
+		"Dockerfile":        "FROM scratch",
+		"api/.dockerignore": "*.tmp\n",
+		"api/Dockerfile":    "FROM scratch",
+		"api/x.tmp":         "",
+	})
+	targets, err := readCompose(filepath.Join(dir, "docker-compose.yml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0].service != "api" || targets[1].service != "web" {
+		t.Fatalf("got targets %+v, want api and web", targets)
+	}
+	api, web := targets[0], targets[1]
+	if api.root != dir || web.root != dir {
+		t.Errorf("roots = %s, %s; want both %s", api.root, web.root, dir)
+	}
+
+	// The shared package has the api context in full, despite the root's
+	// .dockerignore; the api build applies its own.
+	var buf bytes.Buffer
+	if _, err := writeSource(&buf, []buildContext{{dir: api.root}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".dockerignore", "Dockerfile", "api/.dockerignore", "api/Dockerfile", "api/x.tmp", "docker-compose.yml"}
+	if got := archiveFiles(t, buf.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("archive has %q, want %q", got, want)
+	}
+
+	steps := composeSteps("gcr.io/p/api", api)
+	if len(steps) != 1 || steps[0].Dir != "api" {
+		t.Fatalf("api steps = %+v, want one step in api", steps)
+	}
+	wantArgs := []string{"buildx", "build", "-t", "gcr.io/p/api", "-f", "Dockerfile", "--build-arg", "VERSION=1.2", "."}
+	if !reflect.DeepEqual(steps[0].Args, wantArgs) {
+		t.Errorf("api args = %q, want %q", steps[0].Args, wantArgs)
+	}
+}
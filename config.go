@@ -0,0 +1,83 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configFile is the file in the current directory that holds default flag
+// values, such as the one written by cdbuild init.
+const configFile = ".cdbuild.yaml"
+
+// loadConfig sets the flags in fs from the YAML file name, which maps flag
+// names to values. A list sets a repeatable flag once for each element. It
+// is not an error for the file not to exist. Flags set by the command line
+// args are left for it to set, so that it overrides the file, including the
+// values of repeatable flags.
+func loadConfig(fs *flag.FlagSet, name string, args []string) error {
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cfg yaml.MapSlice
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("could not parse %s: %v", name, err)
+	}
+	for _, item := range cfg {
+		key := fmt.Sprint(item.Key)
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("%s: unknown flag %q", name, key)
+		}
+		if hasFlag(fs, args, key) {
+			continue
+		}
+		values, ok := item.Value.([]interface{})
+		if !ok {
+			values = []interface{}{item.Value}
+		}
+		for _, v := range values {
+			if err := fs.Set(key, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: invalid value %q for %s: %v", name, v, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// hasFlag reports whether args, as fs would parse them, set the named flag.
+// The values of flags, such as test in -name test, are not flag names, and
+// parsing stops at the first argument that is not a flag.
+func hasFlag(fs *flag.FlagSet, args []string, name string) bool {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if len(a) < 2 || a[0] != '-' || a == "--" {
+			return false
+		}
+		a = strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-")
+		n, _, hasValue := strings.Cut(a, "=")
+		if n == name {
+			return true
+		}
+		if f := fs.Lookup(n); f != nil && !hasValue && !isBoolFlag(f) {
+			i++ // Skip the flag's value.
+		}
+	}
+	return false
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
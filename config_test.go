@@ -0,0 +1,80 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	name := filepath.Join(t.TempDir(), configFile)
+	cfg := "name: hello\nmirror:\n  - eu.gcr.io/p/hello\n  - asia.gcr.io/p/hello\ncontext:\n  - shared=.\n"
+	if err := ioutil.WriteFile(name, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		args    []string
+		name    string
+		mirrors []string
+	}{
+		{nil, "hello", []string{"eu.gcr.io/p/hello", "asia.gcr.io/p/hello"}},
+		{[]string{"-name=other"}, "other", []string{"eu.gcr.io/p/hello", "asia.gcr.io/p/hello"}},
+		{[]string{"-mirror", "us.gcr.io/p/hello"}, "hello", []string{"us.gcr.io/p/hello"}},
+		// Repeating -context on the command line is not a duplicate of
+		// the file's context.
+		{[]string{"-context", "shared=.", "-mirror", "a", "-mirror", "b"}, "hello", []string{"a", "b"}},
+		// A flag's value is not a flag name: -name mirror does not set
+		// -mirror.
+		{[]string{"-name", "mirror"}, "mirror", []string{"eu.gcr.io/p/hello", "asia.gcr.io/p/hello"}},
+		{[]string{"-v", "-name", "mirror"}, "mirror", []string{"eu.gcr.io/p/hello", "asia.gcr.io/p/hello"}},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		var mirrors stringsFlag
+		var contexts contextFlag
+		n := fs.String("name", "", "")
+		fs.Bool("v", false, "")
+		fs.Var(&mirrors, "mirror", "")
+		fs.Var(&contexts, "context", "")
+		if err := loadConfig(fs, name, tt.args); err != nil {
+			t.Errorf("%q: loadConfig: %v", tt.args, err)
+			continue
+		}
+		if err := fs.Parse(tt.args); err != nil {
+			t.Errorf("%q: Parse: %v", tt.args, err)
+			continue
+		}
+		if *n != tt.name || !reflect.DeepEqual([]string(mirrors), tt.mirrors) || len(contexts) != 1 {
+			t.Errorf("%q: got name %q, mirrors %q, %d contexts; want %q, %q, 1", tt.args, *n, mirrors, len(contexts), tt.name, tt.mirrors)
+		}
+	}
+}
+
+func TestHasFlag(t *testing.T) {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fs.String("name", "", "")
+	fs.String("from", "", "")
+	fs.Bool("test", false, "")
+	for _, tt := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"-from", "cloudbuild.yaml"}, true},
+		{[]string{"--from=cloudbuild.yaml"}, true},
+		{[]string{"-name", "from"}, false},
+		{[]string{"-test", "-name", "from"}, false},
+		{[]string{"-name=x", "-from", "y"}, true},
+		{[]string{"arg", "-from", "y"}, false},
+		{[]string{"--", "-from", "y"}, false},
+	} {
+		if got := hasFlag(fs, tt.args, "from"); got != tt.want {
+			t.Errorf("hasFlag(%q, from) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+// contextsDir is the directory in the source archive under which
+// additional named build contexts are stored. They are moved out of the
+// workspace, to contextsVolume, before the image is built so that they are
+// not part of the main context.
+const contextsDir = ".cdbuild/contexts"
+
+// contextsVolume is where the named build contexts are mounted in the build
+// step.
+const contextsVolume = "/cdbuild-contexts"
+
+var extraContexts contextFlag
+
+func init() {
+	flag.Var(&extraContexts, "context", "Additional named build context, as name=path. May be repeated.")
+}
+
+// buildContext is a local directory packaged into the source archive.
+type buildContext struct {
+	name string // empty for the main context.
+	dir  string
+}
+
+// prefix returns the directory in the archive that holds the context.
+func (c buildContext) prefix() string {
+	if c.name == "" {
+		return ""
+	}
+	return path.Join(contextsDir, c.name)
+}
+
+// contextFlag implements flag.Value for repeated -context flags.
+type contextFlag []buildContext
+
+func (f *contextFlag) String() string {
+	var s []string
+	for _, c := range *f {
+		s = append(s, c.name+"="+c.dir)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *contextFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("context %q must be of the form name=path", v)
+	}
+	name, dir := v[:i], v[i+1:]
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("invalid context name %q", name)
+	}
+	for _, c := range *f {
+		if c.name == name {
+			return fmt.Errorf("context %q specified more than once", name)
+		}
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("context %q: %s is not a directory", name, dir)
+	}
+	*f = append(*f, buildContext{name: name, dir: dir})
+	return nil
+}
+
+// contexts returns the main build context followed by any named contexts.
+func contexts() []buildContext {
+	return append([]buildContext{{dir: "."}}, extraContexts...)
+}
+
+// buildContextArgs returns BuildKit --build-context arguments that make each
+// named context available to the Dockerfile, e.g. COPY --from=name.
+func buildContextArgs() []string {
+	var args []string
+	for _, c := range extraContexts {
+		args = append(args, "--build-context", c.name+"="+path.Join(contextsVolume, c.name))
+	}
+	return args
+}
+
+// moveContextsStep returns the step that moves the named build contexts out
+// of the workspace, and the volume that they are moved to.
+func moveContextsStep() (*cloudbuild.BuildStep, *cloudbuild.Volume) {
+	vol := &cloudbuild.Volume{Name: "cdbuild-contexts", Path: contextsVolume}
+	return &cloudbuild.BuildStep{
+		Name:       "gcr.io/cloud-builders/docker",
+		Entrypoint: "bash",
+		Args:       []string{"-c", fmt.Sprintf("cp -a %s/. %s && rm -r %s", contextsDir, contextsVolume, path.Dir(contextsDir))},
+		Volumes:    []*cloudbuild.Volume{vol},
+	}, vol
+}
+
+// checkContextsDir returns an error if ctxs has named contexts and the main
+// context, ctxs[0], has a file where they are stored. The directory is
+// removed from the workspace before the image is built, so the file would be
+// lost, or mixed up with the named contexts.
+func checkContextsDir(ctxs []buildContext) error {
+	if len(ctxs) < 2 {
+		return nil
+	}
+	dir := path.Dir(contextsDir)
+	if _, err := os.Lstat(filepath.Join(ctxs[0].dir, dir)); !os.IsNotExist(err) {
+		return fmt.Errorf("the build context has %s, where cdbuild stores named build contexts; rename it to use -context", dir)
+	}
+	return nil
+}
+
+// writeContext adds the files in c to tw, and their names, modes and
+// contents to h. Named contexts skip the files matched by their .dockerignore
+// file. The main context is written in full, as test steps may need files
+// that it ignores, and Docker applies its .dockerignore when building the
+// image.
+func writeContext(tw *tar.Writer, h io.Writer, c buildContext) error {
+	var ignore ignoreRules
+	if c.name != "" {
+		var err error
+		if ignore, err = readIgnoreFile(filepath.Join(c.dir, ".dockerignore")); err != nil {
+			return err
+		}
+	}
+	return filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if ignore.excludes(rel) {
+			if info.IsDir() && !ignore.hasExceptions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(c.prefix(), rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %o %d %s\x00", hdr.Name, hdr.Mode, hdr.Size, hdr.Linkname)
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(io.MultiWriter(tw, h), f)
+		return err
+	})
+}
+
+// ignoreRules holds the patterns from a .dockerignore file.
+type ignoreRules []ignorePattern
+
+type ignorePattern struct {
+	pattern   string
+	exception bool // pattern was prefixed with "!".
+}
+
+// readIgnoreFile parses a .dockerignore file. A missing file yields no rules.
+func readIgnoreFile(name string) (ignoreRules, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules ignoreRules
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.exception = true
+			line = strings.TrimSpace(line[1:])
+		}
+		p.pattern = strings.Trim(path.Clean(filepath.ToSlash(line)), "/")
+		rules = append(rules, p)
+	}
+	return rules, s.Err()
+}
+
+func (r ignoreRules) hasExceptions() bool {
+	for _, p := range r {
+		if p.exception {
+			return true
+		}
+	}
+	return false
+}
+
+// excludes reports whether the slash-separated relative path name is
+// excluded. As with Docker, the last matching pattern wins, and a pattern
+// matching a directory also matches everything beneath it.
+func (r ignoreRules) excludes(name string) bool {
+	excluded := false
+	for _, p := range r {
+		if matchPath(p.pattern, name) {
+			excluded = !p.exception
+		}
+	}
+	return excluded
+}
+
+// matchPath reports whether name, or one of its parent directories, matches
+// pattern. Pattern elements are matched with path.Match, and a "**" element
+// matches any number of path elements.
+func matchPath(pattern, name string) bool {
+	pe := strings.Split(pattern, "/")
+	ne := strings.Split(name, "/")
+	for i := len(ne); i > 0; i-- {
+		if matchElems(pe, ne[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
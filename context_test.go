@@ -0,0 +1,140 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// archiveFiles returns the names of the regular files in the gzipped tarball
+// b.
+func archiveFiles(t *testing.T, b []byte) []string {
+	gzr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gzr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWriteSourceHash(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"main.go": "package main", "sub/a.txt": "a"})
+	hash := func() string {
+		h, err := writeSource(ioutil.Discard, []buildContext{{dir: dir}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	before := hash()
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "main.go"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if h := hash(); h != before {
+		t.Errorf("hash changed with modification time: %s, was %s", h, before)
+	}
+	writeFiles(t, dir, map[string]string{"main.go": "package main // changed"})
+	if h := hash(); h == before {
+		t.Error("hash did not change with file contents")
+	}
+}
+
+func TestWriteSource(t *testing.T) {
+	dir, shared := t.TempDir(), t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".dockerignore": "*_test.go\n",
+		"main.go":       "package main",
+		"main_test.go":  "package main",
+	})
+	writeFiles(t, shared, map[string]string{
+		".dockerignore": "tmp\n",
+		"a.proto":       "syntax",
+		"tmp/x":         "",
+	})
+
+	var buf bytes.Buffer
+	_, err := writeSource(&buf, []buildContext{{dir: dir}, {name: "shared", dir: shared}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The main context is written in full, for the tests; named contexts
+	// honor their .dockerignore.
+	want := []string{
+		".cdbuild/contexts/shared/.dockerignore",
+		".cdbuild/contexts/shared/a.proto",
+		".dockerignore",
+		"main.go",
+		"main_test.go",
+	}
+	if got := archiveFiles(t, buf.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("archive has %q, want %q", got, want)
+	}
+
+	// The main context's own .cdbuild directory would be removed with the
+	// named contexts.
+	writeFiles(t, dir, map[string]string{".cdbuild/notes": "mine"})
+	if _, err := writeSource(ioutil.Discard, []buildContext{{dir: dir}, {name: "shared", dir: shared}}); err == nil {
+		t.Error("writeSource succeeded with .cdbuild in the main context")
+	}
+	if _, err := writeSource(ioutil.Discard, []buildContext{{dir: dir}}); err != nil {
+		t.Errorf("writeSource without named contexts: %v", err)
+	}
+}
+
+func TestBuildStepsMovesContexts(t *testing.T) {
+	defer func(c contextFlag) { extraContexts = c }(extraContexts)
+	extraContexts = contextFlag{{name: "shared", dir: "../proto"}}
+
+	steps := buildSteps("gcr.io/p/hello")
+	if len(steps) != 2 {
+		t.Fatalf("got %d steps, want 2", len(steps))
+	}
+	mv, build := steps[0], steps[1]
+	if len(mv.Volumes) != 1 || len(build.Volumes) != 1 || mv.Volumes[0].Path != contextsVolume || build.Volumes[0].Path != contextsVolume {
+		t.Errorf("steps do not share the %s volume", contextsVolume)
+	}
+	want := []string{"buildx", "build", "-t", "gcr.io/p/hello", "--build-context", "shared=" + contextsVolume + "/shared", "."}
+	if !reflect.DeepEqual(build.Args, want) {
+		t.Errorf("build args = %q, want %q", build.Args, want)
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// requestFlags are the flags that describe the build request, and so are
+// expressed as steps, images, artifacts and substitutions in a
+// cloudbuild.yaml. Other flags change what cdbuild does around the build,
+// and are kept in comments.
+var requestFlags = map[string]bool{
+	"project":       true,
+	"name":          true,
+	"test":          true,
+	"test-cmd":      true,
+	"test-image":    true,
+	"smoke-test":    true,
+	"smoke-cmd":     true,
+	"smoke-port":    true,
+	"smoke-path":    true,
+	"smoke-timeout": true,
+	"go-cache":      true,
+	"artifacts":     true,
+	"substitution":  true,
+	"secret":        true,
+	"ssh":           true,
+}
+
+// convertFlags are the flags of cdbuild convert itself, and the logging
+// flags, which are not converted.
+var convertFlags = map[string]bool{"from": true, "o": true, "v": true, "q": true, "log-format": true}
+
+// flagComment prefixes the comments that hold flags with no equivalent in a
+// cloudbuild.yaml.
+const flagComment = "# cdbuild: "
+
+func convertCmd(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	from := fs.String("from", "", "cloudbuild.yaml to convert into cdbuild config. Without it, the cdbuild config and flags are converted into a cloudbuild.yaml.")
+	out := fs.String("o", "", "File to write to. Defaults to standard output.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s convert:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s convert [build flags] > cloudbuild.yaml\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s convert -from cloudbuild.yaml > %s\n", os.Args[0], configFile)
+		fs.PrintDefaults()
+	}
+	// The config file describes the build to convert, unless converting the
+	// other way.
+	if !hasFlag(fs, args, "from") {
+		if err := loadConfig(fs, configFile, args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	fs.Parse(args)
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var b []byte
+	var err error
+	if *from != "" {
+		b, err = convertFromCloudBuild(fs, *from)
+	} else {
+		b, err = convertToCloudBuild(fs)
+	}
+	if err != nil {
+		fatal(logger, "Could not convert", err)
+	}
+	if *out == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+		fatal(logger, "Could not write output", err)
+	}
+}
+
+// convertToCloudBuild returns the cloudbuild.yaml for the build that the
+// flags in fs describe.
+func convertToCloudBuild(fs *flag.FlagSet) ([]byte, error) {
+	switch {
+	case *projectID == "" || *name == "":
+		return nil, errors.New("the project and name flags are required")
+	case strings.Contains(*projectID, ","):
+		return nil, errors.New("convert takes a single project")
+	case len(extraContexts) > 0:
+		return nil, errors.New("named build contexts are uploaded by cdbuild and cannot be expressed in a cloudbuild.yaml")
+	}
+	bucket := "cdbuild-" + *projectID
+	image := "gcr.io/" + *projectID + "/" + *name
+	var gc *goCacheInfo
+	if *goCache {
+		var err error
+		if gc, err = newGoCacheInfo(bucket); err != nil {
+			return nil, err
+		}
+	}
+	req := buildRequest(image, bucket, artifactsPrefix(), buildSteps(image), gc)
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "# Generated by cdbuild convert. Lines starting with \""+strings.TrimSpace(flagComment)+"\" are")
+	fmt.Fprintln(&buf, "# cdbuild flags that cloudbuild.yaml cannot express; cdbuild convert -from")
+	fmt.Fprintln(&buf, "# restores them.")
+	fs.Visit(func(f *flag.Flag) {
+		if requestFlags[f.Name] || convertFlags[f.Name] {
+			return
+		}
+		if l, ok := f.Value.(*stringsFlag); ok {
+			for _, v := range *l {
+				fmt.Fprintf(&buf, "%s%s=%s\n", flagComment, f.Name, v)
+			}
+			return
+		}
+		fmt.Fprintf(&buf, "%s%s=%s\n", flagComment, f.Name, f.Value)
+	})
+
+	y, err := toYAML(req)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(y)
+	return buf.Bytes(), nil
+}
+
+// artifactsPrefix is where artifacts of builds from a cloudbuild.yaml are
+// uploaded in the staging bucket.
+func artifactsPrefix() string {
+	return "artifacts/" + *name + "-$BUILD_ID"
+}
+
+// toYAML encodes v, which has JSON field names, as YAML with the same field
+// names and order.
+func toYAML(v interface{}) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML, and a MapSlice keeps the order of the fields.
+	var ms yaml.MapSlice
+	if err := yaml.Unmarshal(j, &ms); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(ms)
+}
+
+// convertFromCloudBuild returns the cdbuild config equivalent to the
+// cloudbuild.yaml named file. The flags it finds are set in fs, and the
+// build they describe is checked against the file, so that no part of the
+// file is lost.
+func convertFromCloudBuild(fs *flag.FlagSet, file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseCloudBuild(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", file, err)
+	}
+	cfg, gc, err := configFromBuild(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range cfg {
+		values, ok := item.Value.([]string)
+		if !ok {
+			values = []string{fmt.Sprint(item.Value)}
+		}
+		for _, v := range values {
+			if err := fs.Set(item.Key.(string), v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", item.Key, err)
+			}
+		}
+	}
+
+	// Check that the flags describe the same build.
+	bucket := "cdbuild-" + *projectID
+	image := "gcr.io/" + *projectID + "/" + *name
+	if gc != nil {
+		// The cache key depends on the go.sum of the source, so keep the
+		// object of the original.
+		gc.bucket = bucket
+	}
+	want := buildRequest(image, bucket, artifactsPrefix(), buildSteps(image), gc)
+	wj, err := json.Marshal(want)
+	if err != nil {
+		return nil, err
+	}
+	gj, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(wj, gj) {
+		if y, err := toYAML(want); err == nil {
+			fmt.Fprintf(os.Stderr, "The nearest build that cdbuild flags describe is:\n%s\n", y)
+		}
+		return nil, fmt.Errorf("%s cannot be expressed as cdbuild flags without loss", file)
+	}
+
+	comments, err := flagComments(data)
+	if err != nil {
+		return nil, err
+	}
+	cfg = append(cfg, comments...)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Converted by cdbuild convert from %s.\n", file)
+	y, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(y)
+	return buf.Bytes(), nil
+}
+
+// parseCloudBuild parses a cloudbuild.yaml, rejecting fields that the Cloud
+// Build API does not have.
+func parseCloudBuild(data []byte) (*cloudbuild.Build, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	j, err := json.Marshal(jsonCompatible(v))
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	var b cloudbuild.Build
+	if err := dec.Decode(&b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// jsonCompatible converts the maps in a decoded YAML value to maps with
+// string keys, which encoding/json accepts.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonCompatible(e)
+		}
+	}
+	return v
+}
+
+var gcsURL = regexp.MustCompile(`gs://[^\s;]+`)
+
+// configFromBuild returns the flags that describe build b, in config file
+// order, recognizing the steps that cdbuild generates. If b has a Go cache,
+// it is returned too. The flags are not checked to describe all of b.
+func configFromBuild(b *cloudbuild.Build) (yaml.MapSlice, *goCacheInfo, error) {
+	if len(b.Images) != 1 || !strings.HasPrefix(b.Images[0], "gcr.io/") {
+		return nil, nil, errors.New("the build must push exactly one gcr.io image")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(b.Images[0], "gcr.io/"), "/", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("invalid image %s", b.Images[0])
+	}
+	cfg := yaml.MapSlice{{Key: "project", Value: parts[0]}, {Key: "name", Value: parts[1]}}
+	set := func(name string, v interface{}) {
+		if f := flag.Lookup(name); f != nil && fmt.Sprint(v) == f.DefValue {
+			return
+		}
+		cfg = append(cfg, yaml.MapItem{Key: name, Value: v})
+	}
+
+	steps := b.Steps
+	var gc *goCacheInfo
+	if len(steps) > 0 && steps[0].Id == restoreGoCacheStepID {
+		u := gcsURL.FindString(strings.Join(steps[0].Args, " "))
+		bucket, object, err := parseGCSURL(u)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid Go cache step: %v", err)
+		}
+		gc = &goCacheInfo{bucket: bucket, object: object, saved: -1}
+		set("go-cache", true)
+		var rest []*cloudbuild.BuildStep
+		for _, s := range steps {
+			switch s.Id {
+			case restoreGoCacheStepID, loadGoCacheStepID, unloadGoCacheStepID, saveGoCacheStepID:
+			default:
+				rest = append(rest, s)
+			}
+		}
+		steps = rest
+	}
+	if len(steps) > 0 && steps[0].Id == testStepID && len(steps[0].Args) == 2 {
+		set("test", true)
+		set("test-cmd", steps[0].Args[1])
+		set("test-image", steps[0].Name)
+		steps = steps[1:]
+	}
+	if n := len(steps); n > 0 && steps[n-1].Id == smokeStepID && len(steps[n-1].Args) >= 3 {
+		s := steps[n-1]
+		set("smoke-test", true)
+		set("smoke-cmd", strings.Join(s.Args[3:], " "))
+		for _, e := range s.Env {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "SMOKE_PORT":
+				set("smoke-port", kv[1])
+			case "SMOKE_PATH":
+				set("smoke-path", kv[1])
+			case "SMOKE_TIMEOUT":
+				d, err := time.ParseDuration(kv[1] + "s")
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid SMOKE_TIMEOUT %q", kv[1])
+				}
+				set("smoke-timeout", d.String())
+			}
+		}
+	}
+	if b.Artifacts != nil && b.Artifacts.Objects != nil {
+		cfg = append(cfg, yaml.MapItem{Key: "artifacts", Value: b.Artifacts.Objects.Paths})
+	}
+	secrets, ssh := secretFlagsFromBuild(b)
+	if len(secrets) > 0 {
+		cfg = append(cfg, yaml.MapItem{Key: "secret", Value: secrets})
+	}
+	if len(ssh) > 0 {
+		cfg = append(cfg, yaml.MapItem{Key: "ssh", Value: ssh})
+	}
+	if len(b.Substitutions) > 0 {
+		var subs []string
+		for k, v := range b.Substitutions {
+			subs = append(subs, k+"="+v)
+		}
+		sort.Strings(subs)
+		cfg = append(cfg, yaml.MapItem{Key: "substitution", Value: subs})
+	}
+	return cfg, gc, nil
+}
+
+// flagComments returns the flags kept in comments of a cloudbuild.yaml
+// written by cdbuild convert. Repeated flags are returned as lists.
+func flagComments(data []byte) (yaml.MapSlice, error) {
+	var cfg yaml.MapSlice
+	index := make(map[string]int)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, flagComment) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, flagComment), "=", 2)
+		if len(kv) != 2 || flag.Lookup(kv[0]) == nil {
+			return nil, fmt.Errorf("invalid flag comment %q", line)
+		}
+		if _, ok := flag.Lookup(kv[0]).Value.(*stringsFlag); !ok {
+			cfg = append(cfg, yaml.MapItem{Key: kv[0], Value: kv[1]})
+			continue
+		}
+		i, ok := index[kv[0]]
+		if !ok {
+			i = len(cfg)
+			index[kv[0]] = i
+			cfg = append(cfg, yaml.MapItem{Key: kv[0], Value: []string(nil)})
+		}
+		cfg[i].Value = append(cfg[i].Value.([]string), kv[1])
+	}
+	return cfg, sc.Err()
+}
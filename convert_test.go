@@ -0,0 +1,126 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata.")
+
+// resetFlags sets every cdbuild flag back to its default, emptying
+// repeatable flags.
+func resetFlags() {
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") || f.Name == "update" {
+			return
+		}
+		switch v := f.Value.(type) {
+		case *stringsFlag:
+			*v = nil
+		case *contextFlag:
+			*v = nil
+		case *substitutionsFlag:
+			*v = nil
+		case *secretFlag:
+			v.secrets = nil
+		default:
+			f.Value.Set(f.DefValue)
+		}
+	})
+}
+
+// convertFlagSet returns a flag set of the build flags, as cdbuild convert
+// uses.
+func convertFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs
+}
+
+// TestConvertGolden converts each testdata/convert/*.cdbuild.yaml into a
+// cloudbuild.yaml, compares it with the golden file beside it, and converts
+// that back into the original config.
+func TestConvertGolden(t *testing.T) {
+	configs, err := filepath.Glob("testdata/convert/*.cdbuild.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) == 0 {
+		t.Fatal("no test cases")
+	}
+	// The Go cache key is the hash of the go.sum there.
+	t.Chdir("testdata/convert")
+	defer resetFlags()
+	for _, path := range configs {
+		config := filepath.Base(path)
+		golden := strings.TrimSuffix(config, ".cdbuild.yaml") + ".cloudbuild.yaml"
+		t.Run(strings.TrimSuffix(config, ".cdbuild.yaml"), func(t *testing.T) {
+			want, err := ioutil.ReadFile(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resetFlags()
+			fs := convertFlagSet()
+			if err := loadConfig(fs, config, nil); err != nil {
+				t.Fatal(err)
+			}
+			cb, err := convertToCloudBuild(fs)
+			if err != nil {
+				t.Fatalf("convertToCloudBuild: %v", err)
+			}
+			if *update {
+				if err := ioutil.WriteFile(golden, cb, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wantCB, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(cb, wantCB) {
+				t.Errorf("convertToCloudBuild:\n%s\nwant (%s):\n%s", cb, golden, wantCB)
+			}
+
+			resetFlags()
+			got, err := convertFromCloudBuild(convertFlagSet(), golden)
+			if err != nil {
+				t.Fatalf("convertFromCloudBuild: %v", err)
+			}
+			header := "# Converted by cdbuild convert from " + golden + ".\n"
+			if !bytes.HasPrefix(got, []byte(header)) {
+				t.Fatalf("convertFromCloudBuild output does not start with %q:\n%s", header, got)
+			}
+			if got := got[len(header):]; !bytes.Equal(got, want) {
+				t.Errorf("convertFromCloudBuild:\n%s\nwant (%s):\n%s", got, config, want)
+			}
+		})
+	}
+}
+
+func TestFormatSeconds(t *testing.T) {
+	for _, tt := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{30 * time.Second, "30"},
+		{1500 * time.Millisecond, "1.5"},
+		{250 * time.Millisecond, "0.25"},
+		{time.Second + time.Nanosecond, "1.000000001"},
+	} {
+		if got := formatSeconds(tt.d); got != tt.want {
+			t.Errorf("formatSeconds(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// dockerfile holds the parts of a Dockerfile that cdbuild inspects.
+type dockerfile struct {
+	stages []stage
+	labels map[string]string
+}
+
+// stage is a build stage started by a FROM instruction.
+type stage struct {
+	base string // Base image, or the name of an earlier stage.
+	name string // Name given with "AS", if any.
+	line int
+}
+
+// baseImages returns the external images the stages are based on, ignoring
+// references to earlier stages and the empty "scratch" image.
+func (d *dockerfile) baseImages() []stage {
+	names := make(map[string]bool)
+	var imgs []stage
+	for _, s := range d.stages {
+		if !names[strings.ToLower(s.base)] && s.base != "scratch" {
+			imgs = append(imgs, s)
+		}
+		if s.name != "" {
+			names[strings.ToLower(s.name)] = true
+		}
+	}
+	return imgs
+}
+
+func readDockerfile(name string) (*dockerfile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseDockerfile(f)
+}
+
+// parseDockerfile extracts the FROM and LABEL instructions from a Dockerfile.
+// ARG values declared before the first FROM are substituted into FROM lines.
+func parseDockerfile(r io.Reader) (*dockerfile, error) {
+	d := &dockerfile{labels: make(map[string]string)}
+	args := make(map[string]string)
+
+	s := bufio.NewScanner(r)
+	var cont string
+	start, n := 0, 0
+	for s.Scan() {
+		n++
+		line := strings.TrimSpace(s.Text())
+		if cont == "" {
+			start = n
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+		}
+		if strings.HasSuffix(line, `\`) {
+			cont += strings.TrimSuffix(line, `\`) + " "
+			continue
+		}
+		line, cont = cont+line, ""
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			if len(d.stages) == 0 && len(fields) > 1 {
+				kv := strings.SplitN(fields[1], "=", 2)
+				if len(kv) == 2 {
+					args[kv[0]] = strings.Trim(kv[1], `"`)
+				} else {
+					args[kv[0]] = ""
+				}
+			}
+		case "FROM":
+			st := stage{line: start}
+			var rest []string
+			for _, f := range fields[1:] {
+				if !strings.HasPrefix(f, "--") {
+					rest = append(rest, f)
+				}
+			}
+			if len(rest) > 0 {
+				st.base = os.Expand(rest[0], func(k string) string { return args[k] })
+			}
+			if len(rest) == 3 && strings.EqualFold(rest[1], "AS") {
+				st.name = rest[2]
+			}
+			d.stages = append(d.stages, st)
+		case "LABEL":
+			for k, v := range parseLabels(strings.TrimSpace(line[len(fields[0]):])) {
+				d.labels[k] = v
+			}
+		}
+	}
+	return d, s.Err()
+}
+
+// parseLabels parses the key=value pairs of a LABEL instruction. Values may
+// be double-quoted and contain spaces.
+func parseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for s != "" {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		k := strings.Trim(strings.TrimSpace(s[:eq]), `"`)
+		s = s[eq+1:]
+		var v string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for end < len(s) && (s[end] != '"' || s[end-1] == '\\') {
+				end++
+			}
+			v = strings.Replace(s[1:end], `\"`, `"`, -1)
+			if end < len(s) {
+				end++
+			}
+			s = s[end:]
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			v, s = s[:end], s[end:]
+		}
+		labels[k] = v
+		s = strings.TrimSpace(s)
+	}
+	return labels
+}
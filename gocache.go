@@ -0,0 +1,186 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	cstorage "cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+var goCache = flag.Bool("go-cache", false, "Restore the Go module and build caches from the staging bucket before the build, and save them afterwards. The -test steps use them directly, and the Dockerfile through BuildKit cache mounts. Keyed by the hash of go.sum, or of go.mod if there is none.")
+
+// goCacheDir is where the cache volume is mounted in each test step.
+const goCacheDir = "/go-cache"
+
+// goModCacheID and goBuildCacheID are the IDs of the BuildKit cache mounts
+// that hold the module and build caches during the image build. A Dockerfile
+// uses them with, for example,
+//
+//	RUN --mount=type=cache,id=cdbuild-go-mod,target=/go/pkg/mod \
+//	    --mount=type=cache,id=cdbuild-go-build,target=/root/.cache/go-build \
+//	    go build ./...
+const (
+	goModCacheID   = "cdbuild-go-mod"
+	goBuildCacheID = "cdbuild-go-build"
+)
+
+// Step IDs of the steps that move the cache between the bucket, the cache
+// volume and the BuildKit cache mounts of the build's docker daemon.
+const (
+	restoreGoCacheStepID = "restore-go-cache"
+	loadGoCacheStepID    = "load-go-cache"
+	unloadGoCacheStepID  = "unload-go-cache"
+	saveGoCacheStepID    = "save-go-cache"
+)
+
+// goCacheMounts are the RUN --mount options of the BuildKit cache mounts,
+// mounted at mod and build.
+func goCacheMounts(mod, build string) string {
+	return fmt.Sprintf("--mount=type=cache,id=%s,target=%s --mount=type=cache,id=%s,target=%s", goModCacheID, mod, goBuildCacheID, build)
+}
+
+// goCacheInfo describes the Go cache used by a build.
+type goCacheInfo struct {
+	bucket, object string
+	hit            bool  // The cache existed when the build was submitted.
+	restored       int64 // Size of the restored cache, if hit.
+	saved          int64 // Size of the cache saved by the build, or -1 if unknown.
+}
+
+// goCacheKey returns a key identifying the module dependencies of the main
+// build context: the hash of go.sum, or of go.mod for a module without
+// dependencies, which has no go.sum.
+func goCacheKey() (string, error) {
+	f, err := os.Open("go.sum")
+	if os.IsNotExist(err) {
+		f, err = os.Open("go.mod")
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// newGoCacheInfo returns the cache for the current go.sum in bucket, without
+// looking it up.
+func newGoCacheInfo(bucket string) (*goCacheInfo, error) {
+	key, err := goCacheKey()
+	if err != nil {
+		return nil, fmt.Errorf("could not compute cache key: %v", err)
+	}
+	return &goCacheInfo{bucket: bucket, object: "cache/go-" + key + ".tar.gz", saved: -1}, nil
+}
+
+// lookupGoCache finds the cache object for the current go.sum in bucket.
+func lookupGoCache(ctx context.Context, c *cstorage.Client, bucket string) (*goCacheInfo, error) {
+	gc, err := newGoCacheInfo(bucket)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := c.Bucket(bucket).Object(gc.object).Attrs(ctx)
+	switch err {
+	case nil:
+		gc.hit = true
+		gc.restored = attrs.Size
+	case cstorage.ErrObjectNotExist:
+	default:
+		return nil, err
+	}
+	return gc, nil
+}
+
+// wrapSteps surrounds the test and image build steps with steps that restore
+// and save the cache, and points the Go tool at the cache in each test step.
+// The image is built by BuildKit, which cannot mount the cache volume, so the
+// cache is loaded into its cache mounts before the image build and unloaded
+// from them afterwards.
+func (gc *goCacheInfo) wrapSteps(tests, build []*cloudbuild.BuildStep) []*cloudbuild.BuildStep {
+	url := "gs://" + gc.bucket + "/" + gc.object
+	vol := &cloudbuild.Volume{Name: "go-cache", Path: goCacheDir}
+	for _, s := range tests {
+		s.Volumes = append(s.Volumes, vol)
+		s.Env = append(s.Env, "GOMODCACHE="+goCacheDir+"/mod", "GOCACHE="+goCacheDir+"/build")
+	}
+	gsutil := func(id, script string) *cloudbuild.BuildStep {
+		return &cloudbuild.BuildStep{
+			Id:         id,
+			Name:       "gcr.io/cloud-builders/gsutil",
+			Entrypoint: "bash",
+			Args:       []string{"-c", script},
+			Volumes:    []*cloudbuild.Volume{vol},
+		}
+	}
+	docker := func(id, script string) *cloudbuild.BuildStep {
+		return &cloudbuild.BuildStep{
+			Id:         id,
+			Name:       "gcr.io/cloud-builders/docker",
+			Entrypoint: "bash",
+			Args:       []string{"-c", script},
+			Env:        []string{"DOCKER_BUILDKIT=1"},
+			Volumes:    []*cloudbuild.Volume{vol},
+		}
+	}
+	// The Dockerfiles are piped to docker; the volume is the context that
+	// loads the cache mounts, and the destination that they are unloaded to.
+	load := fmt.Sprintf("set -e; mkdir -p %[1]s/mod %[1]s/build; printf '%%s\\n' 'FROM busybox' 'RUN %[2]s --mount=type=bind,target=/c cp -a /c/mod/. /m && cp -a /c/build/. /b' | docker buildx build -f - %[1]s",
+		goCacheDir, goCacheMounts("/m", "/b"))
+	unload := fmt.Sprintf("set -e; printf '%%s\\n' 'FROM busybox AS cache' 'RUN %[2]s mkdir -p /out/mod /out/build && cp -a /m/. /out/mod && cp -a /b/. /out/build' 'FROM scratch' 'COPY --from=cache /out /' | docker buildx build --output type=local,dest=%[1]s -",
+		goCacheDir, goCacheMounts("/m", "/b"))
+	steps := []*cloudbuild.BuildStep{gsutil(restoreGoCacheStepID, fmt.Sprintf("if gsutil -q stat %[1]s; then gsutil -q cp %[1]s - | tar -xzf - -C %[2]s; fi", url, goCacheDir))}
+	steps = append(steps, tests...)
+	steps = append(steps, docker(loadGoCacheStepID, load))
+	steps = append(steps, build...)
+	steps = append(steps, docker(unloadGoCacheStepID, unload))
+	return append(steps, gsutil(saveGoCacheStepID, fmt.Sprintf("set -o pipefail; tar -czf - -C %s . | gsutil -q cp - %s", goCacheDir, url)))
+}
+
+// stat records the size of the cache saved by the build.
+func (gc *goCacheInfo) stat(ctx context.Context, c *cstorage.Client) error {
+	attrs, err := c.Bucket(gc.bucket).Object(gc.object).Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	gc.saved = attrs.Size
+	return nil
+}
+
+func (gc *goCacheInfo) print(w io.Writer) {
+	if gc.hit {
+		fmt.Fprintf(w, "Go cache: hit, restored %s", formatBytes(gc.restored))
+	} else {
+		fmt.Fprint(w, "Go cache: miss")
+	}
+	if gc.saved >= 0 {
+		fmt.Fprintf(w, ", saved %s", formatBytes(gc.saved))
+	}
+	fmt.Fprintf(w, " (gs://%s/%s)\n", gc.bucket, gc.object)
+}
+
+// formatBytes formats n as a human-readable size.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+func TestGoCacheKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if _, err := goCacheKey(); err == nil {
+		t.Error("goCacheKey succeeded without go.sum or go.mod")
+	}
+
+	// A module without dependencies has no go.sum.
+	mod := []byte("module example.com/hello\n")
+	if err := ioutil.WriteFile("go.mod", mod, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(mod)
+	key, err := goCacheKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := hex.EncodeToString(h[:])[:16]; key != want {
+		t.Errorf("key from go.mod = %s, want %s", key, want)
+	}
+
+	sum := []byte("example.com/dep v1.0.0 h1:abc=\n")
+	if err := ioutil.WriteFile("go.sum", sum, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h = sha256.Sum256(sum)
+	if key, err = goCacheKey(); err != nil {
+		t.Fatal(err)
+	}
+	if want := hex.EncodeToString(h[:])[:16]; key != want {
+		t.Errorf("key from go.sum = %s, want %s", key, want)
+	}
+}
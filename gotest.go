@@ -0,0 +1,118 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+// testStepID is the ID of the build step that runs the tests.
+const testStepID = "test"
+
+var (
+	runTests  = flag.Bool("test", false, "Run tests against the uploaded source before building the image.")
+	testCmd   = flag.String("test-cmd", "go test ./...", "Shell command that runs the tests. Use 'go test -json ./...' for a per-package summary.")
+	testImage = flag.String("test-image", "golang", "Image in which the tests are run.")
+)
+
+// testSteps returns the steps that run the tests, or nil if tests were not
+// requested. Cloud Build stops at the first failing step, so steps after
+// these only run if the tests pass.
+func testSteps() []*cloudbuild.BuildStep {
+	if !*runTests {
+		return nil
+	}
+	return []*cloudbuild.BuildStep{
+		{
+			Id:         testStepID,
+			Name:       *testImage,
+			Entrypoint: "sh",
+			Args:       []string{"-c", *testCmd},
+		},
+	}
+}
+
+// testEvent is an event printed by go test -json.
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+}
+
+// packageResult is the outcome of testing a single package.
+type packageResult struct {
+	name                 string
+	action               string // "pass", "fail" or "skip" once the package is done.
+	elapsed              float64
+	passed, failed, skip int
+}
+
+// testReport summarizes go test -json output found in the build log.
+type testReport struct {
+	pkgs  []*packageResult
+	byPkg map[string]*packageResult
+}
+
+func newTestReport() *testReport {
+	return &testReport{byPkg: make(map[string]*packageResult)}
+}
+
+// addLine records the line if it is a go test -json event from the test step.
+func (r *testReport) addLine(line string) {
+	step, text, ok := splitStepLine(line)
+	if !ok || step != testStepID || !strings.HasPrefix(text, "{") {
+		return
+	}
+	var e testEvent
+	if err := json.Unmarshal([]byte(text), &e); err != nil || e.Package == "" {
+		return
+	}
+	p, ok := r.byPkg[e.Package]
+	if !ok {
+		p = &packageResult{name: e.Package}
+		r.byPkg[e.Package] = p
+		r.pkgs = append(r.pkgs, p)
+	}
+	switch {
+	case e.Test == "" && (e.Action == "pass" || e.Action == "fail" || e.Action == "skip"):
+		p.action = e.Action
+		p.elapsed = e.Elapsed
+	case e.Action == "pass":
+		p.passed++
+	case e.Action == "fail":
+		p.failed++
+	case e.Action == "skip":
+		p.skip++
+	}
+}
+
+func (r *testReport) empty() bool {
+	return len(r.pkgs) == 0
+}
+
+func (r *testReport) print(w io.Writer) {
+	for _, p := range r.pkgs {
+		var result string
+		switch p.action {
+		case "pass":
+			result = "ok"
+		case "fail":
+			result = "FAIL"
+		case "skip":
+			result = "?"
+		default:
+			result = "..."
+		}
+		fmt.Fprintf(w, "  %-4s  %s\t%.3fs\t(%d passed, %d failed, %d skipped)\n",
+			result, p.name, p.elapsed, p.passed, p.failed, p.skip)
+	}
+}
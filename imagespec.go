@@ -0,0 +1,402 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var imageSpecFile = flag.String("image-spec", "", "YAML file of assertions about the built image's files, environment, user and size, checked after a successful build.")
+
+// imageSpec describes what the built image must look like.
+type imageSpec struct {
+	// RequiredFiles are absolute paths that must exist in the image.
+	RequiredFiles []string `yaml:"requiredFiles"`
+	// ForbiddenFiles are absolute paths that must not exist in the image.
+	// "*" matches any sequence of characters.
+	ForbiddenFiles []string `yaml:"forbiddenFiles"`
+	// RequiredEnv are environment variables that must be set, either as
+	// NAME or NAME=value.
+	RequiredEnv []string `yaml:"requiredEnv"`
+	NonRoot     bool     `yaml:"nonRoot"`
+	// MaxSize is the largest compressed size of the image, e.g. 200MiB.
+	MaxSize string `yaml:"maxSize"`
+	// MaxSizeIncrease is how much larger than the baseline the image may
+	// be, either as a size or a percentage such as 10%.
+	MaxSizeIncrease string `yaml:"maxSizeIncrease"`
+	// Baseline is the image that MaxSizeIncrease compares against. It
+	// defaults to the image as it was tagged before the build.
+	Baseline string `yaml:"baseline"`
+
+	maxSize        int64
+	forbiddenFiles globs
+}
+
+// specResult is the outcome of checking the built image against the spec.
+type specResult struct {
+	size       int64
+	baseline   string
+	baseSize   int64 // -1 if there was no baseline image.
+	violations []string
+	restored   string // What was done to the tag if the image failed.
+}
+
+// imageInfo is what cdbuild knows about an image from its registry.
+type imageInfo struct {
+	size  int64 // Compressed size of the config and layers.
+	env   []string
+	user  string
+	files map[string]bool // Absolute paths, or nil if layers were not read.
+}
+
+func readImageSpec(name string) (*imageSpec, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var s imageSpec
+	if err := yaml.UnmarshalStrict(b, &s); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", name, err)
+	}
+	if s.MaxSize != "" {
+		if s.maxSize, err = parseSize(s.MaxSize); err != nil {
+			return nil, fmt.Errorf("invalid maxSize: %v", err)
+		}
+	}
+	if s.MaxSizeIncrease != "" {
+		if _, err := s.allowedSize(0); err != nil {
+			return nil, fmt.Errorf("invalid maxSizeIncrease: %v", err)
+		}
+	}
+	s.forbiddenFiles = compileGlobs(s.ForbiddenFiles)
+	return &s, nil
+}
+
+// allowedSize returns the largest size the image may be given the size of
+// the baseline image.
+func (s *imageSpec) allowedSize(base int64) (int64, error) {
+	if strings.HasSuffix(s.MaxSizeIncrease, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s.MaxSizeIncrease, "%"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid percentage %q", s.MaxSizeIncrease)
+		}
+		return base + int64(float64(base)*pct/100), nil
+	}
+	n, err := parseSize(s.MaxSizeIncrease)
+	return base + n, err
+}
+
+// needsFiles reports whether checking the spec requires reading the layers.
+func (s *imageSpec) needsFiles() bool {
+	return len(s.RequiredFiles) > 0 || len(s.ForbiddenFiles) > 0
+}
+
+// baselineSize returns the size of the baseline image for image, or -1 if it
+// does not exist.
+func (s *imageSpec) baselineSize(ctx context.Context, rc *registryClient, image string) (string, int64, error) {
+	base := image
+	if s.Baseline != "" {
+		base = s.Baseline
+	}
+	r, err := parseImageRef(base)
+	if err != nil {
+		return "", 0, err
+	}
+	info, err := inspectImage(ctx, rc, r, false)
+	if isNotFound(err) {
+		return r.String(), -1, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return r.String(), info.size, nil
+}
+
+// check returns the ways in which info does not meet the spec. baseSize is
+// the size of the baseline image, or -1 if there is none.
+func (s *imageSpec) check(info *imageInfo, baseSize int64) []string {
+	var v []string
+	for _, f := range s.RequiredFiles {
+		if !info.files[path.Clean(f)] {
+			v = append(v, fmt.Sprintf("required file %s does not exist", f))
+		}
+	}
+	if len(s.forbiddenFiles) > 0 {
+		var paths []string
+		for f := range info.files {
+			paths = append(paths, f)
+		}
+		sort.Strings(paths)
+		for _, f := range paths {
+			if s.forbiddenFiles.match(f) {
+				v = append(v, fmt.Sprintf("forbidden file %s exists", f))
+			}
+		}
+	}
+	for _, e := range s.RequiredEnv {
+		if !hasEnv(info.env, e) {
+			v = append(v, fmt.Sprintf("environment variable %s is not set", e))
+		}
+	}
+	if s.NonRoot && isRoot(info.user) {
+		v = append(v, fmt.Sprintf("image runs as root (user %q)", info.user))
+	}
+	if s.maxSize > 0 && info.size > s.maxSize {
+		v = append(v, fmt.Sprintf("size %s exceeds maximum of %s", formatBytes(info.size), formatBytes(s.maxSize)))
+	}
+	if s.MaxSizeIncrease != "" && baseSize >= 0 {
+		allowed, _ := s.allowedSize(baseSize)
+		if info.size > allowed {
+			v = append(v, fmt.Sprintf("size %s grew by more than %s from %s", formatBytes(info.size), s.MaxSizeIncrease, formatBytes(baseSize)))
+		}
+	}
+	return v
+}
+
+// checkImageSpec checks the image built by b against spec. baseSize is the
+// size of the baseline image, or -1 if there is none.
+func checkImageSpec(ctx context.Context, rc *registryClient, spec *imageSpec, b *cloudbuild.Build, image, baseline string, baseSize int64) (*specResult, error) {
+	digest, err := builtDigest(b, image)
+	if err != nil {
+		return nil, err
+	}
+	r, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+	info, err := inspectImage(ctx, rc, r.withRef(digest), spec.needsFiles())
+	if err != nil {
+		return nil, err
+	}
+	return &specResult{
+		size:       info.size,
+		baseline:   baseline,
+		baseSize:   baseSize,
+		violations: spec.check(info, baseSize),
+	}, nil
+}
+
+// savedTag is the manifest that an image's tag pointed at before the build.
+// Cloud Build pushes the tag before the image can be checked against its
+// spec, so the tag is put back if the image does not meet it.
+type savedTag struct {
+	ref       imageRef
+	manifest  []byte // nil if the tag did not exist.
+	mediaType string
+}
+
+// saveTag records what the tag of image points at.
+func saveTag(ctx context.Context, rc *registryClient, image string) (*savedTag, error) {
+	r, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+	b, mediaType, _, err := rc.getManifest(ctx, r)
+	if isNotFound(err) {
+		return &savedTag{ref: r}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &savedTag{ref: r, manifest: b, mediaType: mediaType}, nil
+}
+
+// restore points the tag back at the saved manifest, or removes the tag if
+// it did not exist, and describes what it did.
+func (t *savedTag) restore(ctx context.Context, rc *registryClient) (string, error) {
+	if t.manifest == nil {
+		if err := rc.deleteManifest(ctx, t.ref); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("removed tag %s", t.ref), nil
+	}
+	digest, err := rc.putManifest(ctx, t.ref, t.mediaType, t.manifest)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("restored tag %s to %s", t.ref, digest), nil
+}
+
+// hasEnv reports whether env sets want, which is either NAME or NAME=value.
+func hasEnv(env []string, want string) bool {
+	for _, e := range env {
+		if e == want || strings.HasPrefix(e, want+"=") && !strings.Contains(want, "=") {
+			return true
+		}
+	}
+	return false
+}
+
+// isRoot reports whether an image's configured user is root.
+func isRoot(user string) bool {
+	u := strings.SplitN(user, ":", 2)[0]
+	return u == "" || u == "root" || u == "0"
+}
+
+// inspectImage reads the config of the image that r refers to and, if files
+// is set, the paths in its filesystem. For an image index, the first image
+// in the index is inspected.
+func inspectImage(ctx context.Context, rc *registryClient, r imageRef, files bool) (*imageInfo, error) {
+	b, _, _, err := rc.getManifest(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("could not parse manifest of %s: %v", r, err)
+	}
+	if len(m.Manifests) > 0 {
+		return inspectImage(ctx, rc, r.withRef(m.Manifests[0].Digest), files)
+	}
+	if m.Config == nil {
+		return nil, fmt.Errorf("manifest of %s has no config", r)
+	}
+
+	info := &imageInfo{size: m.Config.Size}
+	for _, l := range m.Layers {
+		info.size += l.Size
+	}
+	cb, err := rc.getBlob(ctx, r, m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Config struct {
+			Env  []string
+			User string
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(cb, &config); err != nil {
+		return nil, fmt.Errorf("could not parse config of %s: %v", r, err)
+	}
+	info.env = config.Config.Env
+	info.user = config.Config.User
+
+	if !files {
+		return info, nil
+	}
+	info.files = make(map[string]bool)
+	for _, l := range m.Layers {
+		if err := readLayer(ctx, rc, r, l, info.files); err != nil {
+			return nil, fmt.Errorf("could not read layer %s of %s: %v", l.Digest, r, err)
+		}
+	}
+	return info, nil
+}
+
+// readLayer applies the layer l to files, adding the paths it creates and
+// removing those it whites out.
+func readLayer(ctx context.Context, rc *registryClient, r imageRef, l descriptor, files map[string]bool) error {
+	body, err := rc.openBlob(ctx, r, l.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var tr *tar.Reader
+	switch {
+	case strings.Contains(l.MediaType, "gzip"):
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr = tar.NewReader(gz)
+	case strings.HasSuffix(l.MediaType, "tar"):
+		tr = tar.NewReader(body)
+	default:
+		return fmt.Errorf("unsupported media type %s", l.MediaType)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+		switch {
+		case base == ".wh..wh..opq":
+			// An opaque directory hides everything from lower layers.
+			removePaths(files, dir)
+		case strings.HasPrefix(base, ".wh."):
+			target := dir + strings.TrimPrefix(base, ".wh.")
+			delete(files, target)
+			removePaths(files, target+"/")
+		default:
+			files[name] = true
+		}
+	}
+}
+
+// removePaths removes every path under the directory prefix, which ends in a
+// slash.
+func removePaths(files map[string]bool, prefix string) {
+	for f := range files {
+		if strings.HasPrefix(f, prefix) {
+			delete(files, f)
+		}
+	}
+}
+
+// parseSize parses a size such as 200MB or 1.5GiB. Without a unit, the size
+// is in bytes.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		n      float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	}
+	mult := 1.0
+	num := strings.TrimSpace(s)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			mult = u.n
+			num = strings.TrimSpace(strings.TrimSuffix(num, u.suffix))
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * mult), nil
+}
+
+func (r *specResult) print(w io.Writer) {
+	fmt.Fprintf(w, "Image spec: size %s", formatBytes(r.size))
+	if r.baseSize > 0 {
+		fmt.Fprintf(w, " (%s was %s, %+.1f%%)", r.baseline, formatBytes(r.baseSize), float64(r.size-r.baseSize)/float64(r.baseSize)*100)
+	}
+	fmt.Fprintln(w)
+	if len(r.violations) == 0 {
+		fmt.Fprintln(w, "  ok    all checks passed")
+	}
+	for _, v := range r.violations {
+		fmt.Fprintf(w, "  FAIL  %s\n", v)
+	}
+	if r.restored != "" {
+		fmt.Fprintf(w, "        %s\n", r.restored)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestImageSpecCheck(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "spec.yaml")
+	err := ioutil.WriteFile(name, []byte(`
+requiredFiles: [/app/server]
+forbiddenFiles: ["/root/.ssh/*", "*.pem"]
+nonRoot: true
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := readImageSpec(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &imageInfo{files: map[string]bool{
+		"/app/server":          true,
+		"/app/key.pem":         true,
+		"/root/.ssh/id_rsa":    true,
+		"/root/.ssh.d/id_rsa":  true,
+		"/etc/ssl/ca.pem.note": true,
+	}}
+	want := []string{
+		"forbidden file /app/key.pem exists",
+		"forbidden file /root/.ssh/id_rsa exists",
+		`image runs as root (user "")`,
+	}
+	if got := spec.check(info, -1); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("check = %q, want %q", got, want)
+	}
+}
+
+func TestSavedTagRestore(t *testing.T) {
+	reg, ts := newFakeRegistry(t)
+	host := strings.TrimPrefix(ts.URL, "https://")
+	rc := testRegistryClient(ts)
+	ctx := context.Background()
+	old := reg.addImage("p/app", "v1", []byte(`{"os": "linux"}`), []byte("old layer"))
+
+	saved, err := saveTag(ctx, rc, host+"/p/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedNew, err := saveTag(ctx, rc, host+"/p/app:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The build pushes both tags.
+	reg.addImage("p/app", "v1", []byte(`{"os": "linux"}`), []byte("new layer"))
+	reg.addImage("p/app", "v2", []byte(`{"os": "linux"}`), []byte("new layer"))
+
+	if _, err := saved.restore(ctx, rc); err != nil {
+		t.Fatal(err)
+	}
+	if got := digestOf(reg.manifests["p/app:v1"]); got != old {
+		t.Errorf("v1 is %s after restore, want %s", got, old)
+	}
+	if _, err := savedNew.restore(ctx, rc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reg.manifests["p/app:v2"]; ok {
+		t.Error("new tag v2 was not removed")
+	}
+	if !bytes.Equal(reg.manifests["p/app:"+old], reg.manifests["p/app:v1"]) {
+		t.Error("old manifest is missing")
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	serviceusage "google.golang.org/api/serviceusage/v1"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// requiredAPIs are the APIs that cdbuild uses.
+var requiredAPIs = []string{
+	"cloudbuild.googleapis.com",
+	"containerregistry.googleapis.com",
+	"containerscanning.googleapis.com",
+	"storage.googleapis.com",
+}
+
+// builderProjectRoles are granted to the Cloud Build service account on the
+// project, and builderBucketRoles on the staging bucket, which steps such as
+// the Go cache read and write.
+var (
+	builderProjectRoles = []string{"roles/cloudbuild.builds.builder"}
+	builderBucketRoles  = []string{"roles/storage.objectAdmin"}
+)
+
+// approverRole is granted to approvers on the approvals bucket.
+const approverRole = "roles/storage.objectCreator"
+
+// initStep is a change that cdbuild init makes to a project.
+type initStep struct {
+	desc  string
+	done  bool // The project is already in the desired state.
+	apply func(ctx context.Context) error
+}
+
+// initPlan is the set of changes needed to set up a project for cdbuild.
+type initPlan struct {
+	hc        *http.Client
+	project   string
+	approvers []string
+	steps     []*initStep
+}
+
+func (p *initPlan) add(desc string, done bool, apply func(ctx context.Context) error) {
+	p.steps = append(p.steps, &initStep{desc: desc, done: done, apply: apply})
+}
+
+func initCmd(args []string) {
+	fs := commandFlags("init", "")
+	apply := fs.Bool("apply", false, "Make the changes. Without it, init only shows what it would change.")
+	imageName := fs.String("name", "", "Image name to write to the starter "+configFile+". Defaults to the name of the current directory.")
+	fs.StringVar(auditSink, "audit", "", "The -audit sink that builds will use. With bucket, object retention is enabled on the staging bucket, which cannot be undone.")
+	var approvers stringsFlag
+	fs.Var(&approvers, "approver", "Member, such as user:alice@example.com or group:release@example.com, who may approve builds with cdbuild approve. Creates the approvals bucket, which only approvers can write to. May be repeated.")
+	parseCommandFlags(fs, args)
+	if *imageName == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			fatal(logger, "Could not get working directory", err)
+		}
+		*imageName = filepath.Base(wd)
+	}
+
+	ctx := context.Background()
+	hc, err := google.DefaultClient(ctx, storage.CloudPlatformScope)
+	if err != nil {
+		fatal(logger, "Could not get authenticated HTTP client", err)
+	}
+	traceHTTP(hc)
+
+	p := &initPlan{hc: hc, project: *projectID, approvers: approvers}
+	if err := p.plan(ctx, *imageName); err != nil {
+		fatal(logger, "Could not inspect project", err, "project", *projectID)
+	}
+	pending := 0
+	fmt.Printf("Plan for project %s:\n", *projectID)
+	for _, s := range p.steps {
+		if s.done {
+			fmt.Printf("  ok  %s\n", s.desc)
+			continue
+		}
+		fmt.Printf("  +   %s\n", s.desc)
+		pending++
+	}
+	if pending == 0 {
+		fmt.Println("Nothing to do; the project is set up for cdbuild.")
+		return
+	}
+	if !*apply {
+		fmt.Printf("%d changes. Run again with -apply to make them.\n", pending)
+		return
+	}
+	for _, s := range p.steps {
+		if s.done {
+			continue
+		}
+		logger.Info("Applying change", "project", *projectID, "change", s.desc)
+		if err := s.apply(ctx); err != nil {
+			fatal(logger, "Could not apply change", err, "project", *projectID, "change", s.desc)
+		}
+	}
+	fmt.Printf("Applied %d changes; the project is set up for cdbuild.\n", pending)
+}
+
+// plan inspects the project and records the steps needed to set it up. It
+// makes no changes.
+func (p *initPlan) plan(ctx context.Context, imageName string) error {
+	if err := p.planAPIs(ctx); err != nil {
+		return err
+	}
+	bucket := "cdbuild-" + p.project
+	if err := p.planBucket(ctx, bucket); err != nil {
+		return err
+	}
+	if err := p.planIAM(ctx, bucket); err != nil {
+		return err
+	}
+	if len(p.approvers) > 0 {
+		if err := p.planApprovals(ctx, approvalsBucket(p.project)); err != nil {
+			return err
+		}
+	}
+	p.planConfig(imageName)
+	return nil
+}
+
+func (p *initPlan) planAPIs(ctx context.Context) error {
+	su, err := serviceusage.NewService(ctx, option.WithHTTPClient(p.hc))
+	if err != nil {
+		return err
+	}
+	parent := "projects/" + p.project
+	var disabled []string
+	for _, api := range requiredAPIs {
+		svc, err := su.Services.Get(parent + "/services/" + api).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("could not get state of %s: %v", api, err)
+		}
+		if svc.State != "ENABLED" {
+			disabled = append(disabled, api)
+		}
+	}
+	if len(disabled) == 0 {
+		p.add("enable APIs: "+strings.Join(requiredAPIs, ", "), true, nil)
+		return nil
+	}
+	p.add("enable APIs: "+strings.Join(disabled, ", "), false, func(ctx context.Context) error {
+		op, err := su.Services.BatchEnable(parent, &serviceusage.BatchEnableServicesRequest{ServiceIds: disabled}).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		for !op.Done {
+			time.Sleep(2 * time.Second)
+			if op, err = su.Operations.Get(op.Name).Context(ctx).Do(); err != nil {
+				return err
+			}
+		}
+		if op.Error != nil {
+			return fmt.Errorf("could not enable APIs: %s", op.Error.Message)
+		}
+		return nil
+	})
+	return nil
+}
+
+func (p *initPlan) planBucket(ctx context.Context, bucket string) error {
+	s, err := storage.New(p.hc)
+	if err != nil {
+		return err
+	}
+	b, err := s.Buckets.Get(bucket).Context(ctx).Do()
+	if isAPINotFound(err) {
+		changes := hardenBucket(&storage.Bucket{})
+		if *auditSink == "bucket" {
+			changes = append(changes, "enable object retention")
+		}
+		p.add(fmt.Sprintf("create bucket gs://%s (%s)", bucket, strings.Join(changes, ", ")), false, func(ctx context.Context) error {
+			return setupBucket(ctx, p.hc, p.project, bucket)
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	changes := hardenBucket(b)
+	if *auditSink == "bucket" && (b.ObjectRetention == nil || b.ObjectRetention.Mode != "Enabled") {
+		b.ObjectRetention = &storage.BucketObjectRetention{Mode: "Enabled"}
+		changes = append(changes, "enable object retention")
+	}
+	if len(changes) == 0 {
+		p.add(fmt.Sprintf("harden bucket gs://%s", bucket), true, nil)
+		return nil
+	}
+	p.add(fmt.Sprintf("harden bucket gs://%s: %s", bucket, strings.Join(changes, ", ")), false, func(ctx context.Context) error {
+		_, err := s.Buckets.Patch(bucket, &storage.Bucket{
+			IamConfiguration: b.IamConfiguration,
+			Lifecycle:        b.Lifecycle,
+			ObjectRetention:  b.ObjectRetention,
+		}).Context(ctx).Do()
+		return err
+	})
+	return nil
+}
+
+// policyVersion is the IAM policy version that init reads and writes.
+const policyVersion = 3
+
+func (p *initPlan) planIAM(ctx context.Context, bucket string) error {
+	crm, err := cloudresourcemanager.NewService(ctx, option.WithHTTPClient(p.hc))
+	if err != nil {
+		return err
+	}
+	proj, err := crm.Projects.Get(p.project).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("could not get project number: %v", err)
+	}
+	member := fmt.Sprintf("serviceAccount:%d@cloudbuild.gserviceaccount.com", proj.ProjectNumber)
+	// Policy version 3, so that conditional role bindings are read, and kept
+	// when the policy is written back.
+	policyRequest := &cloudresourcemanager.GetIamPolicyRequest{
+		Options: &cloudresourcemanager.GetPolicyOptions{RequestedPolicyVersion: policyVersion},
+	}
+
+	pol, err := crm.Projects.GetIamPolicy(p.project, policyRequest).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	for _, role := range builderProjectRoles {
+		role := role
+		done := false
+		for _, b := range pol.Bindings {
+			if b.Role == role && b.Condition == nil && hasMember(b.Members, member) {
+				done = true
+			}
+		}
+		p.add(fmt.Sprintf("grant %s on project to %s", role, member), done, func(ctx context.Context) error {
+			pol, err := crm.Projects.GetIamPolicy(p.project, policyRequest).Context(ctx).Do()
+			if err != nil {
+				return err
+			}
+			pol.Bindings = append(pol.Bindings, &cloudresourcemanager.Binding{Role: role, Members: []string{member}})
+			_, err = crm.Projects.SetIamPolicy(p.project, &cloudresourcemanager.SetIamPolicyRequest{Policy: pol}).Context(ctx).Do()
+			return err
+		})
+	}
+
+	s, err := storage.New(p.hc)
+	if err != nil {
+		return err
+	}
+	bpol, err := s.Buckets.GetIamPolicy(bucket).OptionsRequestedPolicyVersion(policyVersion).Context(ctx).Do()
+	if err != nil && !isAPINotFound(err) {
+		return err
+	}
+	for _, role := range builderBucketRoles {
+		role := role
+		done := false
+		if bpol != nil {
+			for _, b := range bpol.Bindings {
+				if b.Role == role && b.Condition == nil && hasMember(b.Members, member) {
+					done = true
+				}
+			}
+		}
+		p.add(fmt.Sprintf("grant %s on gs://%s to %s", role, bucket, member), done, func(ctx context.Context) error {
+			pol, err := s.Buckets.GetIamPolicy(bucket).OptionsRequestedPolicyVersion(policyVersion).Context(ctx).Do()
+			if err != nil {
+				return err
+			}
+			pol.Bindings = append(pol.Bindings, &storage.PolicyBindings{Role: role, Members: []string{member}})
+			_, err = s.Buckets.SetIamPolicy(bucket, pol).Context(ctx).Do()
+			return err
+		})
+	}
+	return nil
+}
+
+// planApprovals creates the approvals bucket, and grants the approvers
+// write access to it. Requesters need read access, which is not granted
+// here.
+func (p *initPlan) planApprovals(ctx context.Context, bucket string) error {
+	s, err := storage.New(p.hc)
+	if err != nil {
+		return err
+	}
+	_, err = s.Buckets.Get(bucket).Context(ctx).Do()
+	exists := err == nil
+	if err != nil && !isAPINotFound(err) {
+		return err
+	}
+	p.add(fmt.Sprintf("create approvals bucket gs://%s", bucket), exists, func(ctx context.Context) error {
+		b := &storage.Bucket{Name: bucket, IamConfiguration: &storage.BucketIamConfiguration{
+			UniformBucketLevelAccess: &storage.BucketIamConfigurationUniformBucketLevelAccess{Enabled: true},
+			PublicAccessPrevention:   "enforced",
+		}}
+		_, err := s.Buckets.Insert(p.project, b).Context(ctx).Do()
+		return err
+	})
+
+	var pol *storage.Policy
+	if exists {
+		if pol, err = s.Buckets.GetIamPolicy(bucket).OptionsRequestedPolicyVersion(policyVersion).Context(ctx).Do(); err != nil {
+			return err
+		}
+	}
+	for _, member := range p.approvers {
+		member := member
+		done := false
+		if pol != nil {
+			for _, b := range pol.Bindings {
+				if b.Role == approverRole && b.Condition == nil && hasMember(b.Members, member) {
+					done = true
+				}
+			}
+		}
+		p.add(fmt.Sprintf("grant %s on gs://%s to %s", approverRole, bucket, member), done, func(ctx context.Context) error {
+			pol, err := s.Buckets.GetIamPolicy(bucket).OptionsRequestedPolicyVersion(policyVersion).Context(ctx).Do()
+			if err != nil {
+				return err
+			}
+			pol.Bindings = append(pol.Bindings, &storage.PolicyBindings{Role: approverRole, Members: []string{member}})
+			_, err = s.Buckets.SetIamPolicy(bucket, pol).Context(ctx).Do()
+			return err
+		})
+	}
+	return nil
+}
+
+func (p *initPlan) planConfig(imageName string) {
+	if _, err := os.Stat(configFile); err == nil {
+		p.add("write "+configFile, true, nil)
+		return
+	}
+	p.add("write "+configFile, false, func(ctx context.Context) error {
+		return ioutil.WriteFile(configFile, []byte(starterConfig(p.project, imageName)), 0644)
+	})
+}
+
+// starterConfig returns the contents of a new config file.
+func starterConfig(project, imageName string) string {
+	return fmt.Sprintf(`# Default flags for cdbuild in this directory. Flags given on the command
+# line override these. Run cdbuild -h for the full list.
+project: %q
+name: %q
+
+# Run the tests before building the image, streaming the build log.
+# test: true
+# test-cmd: go test -json ./...
+
+# Cache the Go modules and build outputs of the tests between builds.
+# go-cache: true
+`, project, imageName)
+}
+
+func hasMember(members []string, m string) bool {
+	for _, x := range members {
+		if x == m {
+			return true
+		}
+	}
+	return false
+}
+
+// isAPINotFound reports whether err is a 404 response from a Google API.
+func isAPINotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == 404
+}
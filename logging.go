@@ -0,0 +1,173 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	verbosity verbosityFlag
+	quiet     = flag.Bool("q", false, "Only log warnings and errors.")
+	logFormat = flag.String("log-format", "text", "Log format: text or json.")
+)
+
+func init() {
+	flag.Var(&verbosity, "v", "Log more detail. Repeat (-v -v) to also trace HTTP requests.")
+}
+
+// levelTrace is the level at which HTTP requests and responses are logged.
+const levelTrace = slog.LevelDebug - 4
+
+// logger is the logger used for all of cdbuild's own messages. Output
+// produced by the build itself is written to stdout instead.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// logLevel is the level set by setupLogging.
+var logLevel = slog.LevelInfo
+
+// verbosityFlag counts the number of times a boolean flag is given.
+type verbosityFlag int
+
+func (f *verbosityFlag) String() string   { return strconv.Itoa(int(*f)) }
+func (f *verbosityFlag) IsBoolFlag() bool { return true }
+
+func (f *verbosityFlag) Set(v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	if b {
+		*f++
+	}
+	return nil
+}
+
+// setupLogging configures logger according to the -v, -q and -log-format
+// flags.
+func setupLogging() error {
+	level := slog.LevelInfo
+	switch {
+	case *quiet && verbosity > 0:
+		return errors.New("-q and -v are mutually exclusive")
+	case *quiet:
+		level = slog.LevelWarn
+	case verbosity == 1:
+		level = slog.LevelDebug
+	case verbosity > 1:
+		level = levelTrace
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		return fmt.Errorf("unknown log format %q", *logFormat)
+	}
+	logLevel = level
+	logger = newLogger(os.Stderr)
+	return nil
+}
+
+// newLogger returns a logger that writes to w at the level and in the format
+// configured by setupLogging.
+func newLogger(w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: redactAttr}
+	if *logFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// fatal logs msg and err at error level, flushes telemetry, and exits.
+func fatal(l *slog.Logger, msg string, err error, args ...interface{}) {
+	if err != nil {
+		args = append(args, "error", err.Error())
+	}
+	l.Error(msg, args...)
+	if tel.root != nil {
+		if err != nil {
+			msg += ": " + err.Error()
+		}
+		tel.root.end(errors.New(msg))
+	}
+	shutdownTelemetry()
+	os.Exit(1)
+}
+
+// tracingTransport logs each HTTP request and response at trace level.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if !logger.Enabled(ctx, levelTrace) {
+		return t.base.RoundTrip(req)
+	}
+	logger.Log(ctx, levelTrace, "HTTP request",
+		"method", req.Method,
+		"url", req.URL.String(),
+		"headers", redactHeaders(req.Header))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		logger.Log(ctx, levelTrace, "HTTP request failed", "url", req.URL.String(), "error", err.Error())
+		return nil, err
+	}
+	logger.Log(ctx, levelTrace, "HTTP response",
+		"url", req.URL.String(),
+		"status", resp.StatusCode,
+		"headers", redactHeaders(resp.Header))
+	return resp, nil
+}
+
+// redactHeaders returns a copy of h with credentials removed.
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Goog-Iam-Authorization-Token"} {
+		if _, ok := h[k]; ok {
+			h.Set(k, "REDACTED")
+		}
+	}
+	return h
+}
+
+// traceHTTP makes hc log its requests and responses at trace level.
+func traceHTTP(hc *http.Client) {
+	if t, ok := hc.Transport.(*oauth2.Transport); ok {
+		// Trace beneath the oauth2 transport, so that the Authorization
+		// header it adds is logged (redacted).
+		t.Base = tracingTransport{base: defaultTransport(t.Base)}
+		return
+	}
+	hc.Transport = tracingTransport{base: defaultTransport(hc.Transport)}
+}
+
+func defaultTransport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		return http.DefaultTransport
+	}
+	return rt
+}
+
+// jsonValue is a slog.LogValuer that logs v as JSON, rather than with the
+// %+v formatting that slog would otherwise use for structs.
+type jsonValue struct {
+	v interface{}
+}
+
+func (j jsonValue) LogValue() slog.Value {
+	b, err := json.Marshal(j.v)
+	if err != nil {
+		return slog.StringValue(fmt.Sprintf("%+v", j.v))
+	}
+	return slog.StringValue(string(b))
+}
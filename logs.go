@@ -0,0 +1,129 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	cstorage "cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// logTailer follows a build log as Cloud Build appends to it in the logs
+// bucket, passing each complete line to handle.
+type logTailer struct {
+	obj     *cstorage.ObjectHandle
+	handle  func(line string)
+	offset  int64
+	partial []byte
+}
+
+func newLogTailer(c *cstorage.Client, bucket, buildID string, handle func(line string)) *logTailer {
+	return &logTailer{
+		obj:    c.Bucket(bucket).Object("log-" + buildID + ".txt"),
+		handle: handle,
+	}
+}
+
+// poll reads anything appended to the log since the last call.
+func (t *logTailer) poll(ctx context.Context) error {
+	r, err := t.obj.NewRangeReader(ctx, t.offset, -1)
+	if err == cstorage.ErrObjectNotExist {
+		// The log is not written until the build starts.
+		return nil
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusRequestedRangeNotSatisfiable {
+		// Nothing has been appended since the last read.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	t.offset += int64(len(b))
+
+	b = append(t.partial, b...)
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			break
+		}
+		t.handle(string(b[:i]))
+		b = b[i+1:]
+	}
+	t.partial = append([]byte(nil), b...)
+	return nil
+}
+
+// logSettleDelay is how long finish waits for the log to grow after the
+// build is done, and logSettleReads how many times at most.
+var (
+	logSettleDelay = time.Second
+	logSettleReads = 5
+)
+
+// finish reads the rest of the log once the build is done. Cloud Build may
+// write the last lines after the build's status has changed, so it reads
+// until the log stops growing.
+func (t *logTailer) finish(ctx context.Context) error {
+	if err := t.poll(ctx); err != nil {
+		return err
+	}
+	for i := 0; i < logSettleReads; i++ {
+		time.Sleep(logSettleDelay)
+		before := t.offset
+		if err := t.poll(ctx); err != nil {
+			return err
+		}
+		if t.offset == before {
+			break
+		}
+	}
+	t.flush()
+	return nil
+}
+
+// flush passes any trailing line that lacks a newline to handle.
+func (t *logTailer) flush() {
+	if len(t.partial) > 0 {
+		t.handle(string(t.partial))
+		t.partial = nil
+	}
+}
+
+// splitStepLine splits a build log line of the form
+//
+//	Step #1 - "test": output
+//
+// into the step's ID and its output. Steps without an ID are identified by
+// their number, e.g. "#1". ok is false for lines not produced by a step.
+func splitStepLine(line string) (step, text string, ok bool) {
+	if !strings.HasPrefix(line, "Step #") {
+		return "", "", false
+	}
+	i := strings.Index(line, ": ")
+	if i < 0 {
+		return "", "", false
+	}
+	head, text := line[len("Step "):i], line[i+2:]
+	if j := strings.Index(head, ` - "`); j >= 0 && strings.HasSuffix(head, `"`) {
+		return head[j+4 : len(head)-1], text, true
+	}
+	if strings.ContainsAny(head, ` "`) {
+		return "", "", false
+	}
+	return head, text, true
+}
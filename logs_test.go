@@ -0,0 +1,121 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cstorage "cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+)
+
+// fakeLog serves a build log that grows, answering range reads past its end
+// with 416 as Cloud Storage does.
+type fakeLog struct {
+	data string
+}
+
+func (l *fakeLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	from := 0
+	if rh := r.Header.Get("Range"); rh != "" {
+		from, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rh, "bytes="), "-"))
+	}
+	if l.data == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if from >= len(l.data) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", from, len(l.data)-1, len(l.data)))
+	w.WriteHeader(http.StatusPartialContent)
+	fmt.Fprint(w, l.data[from:])
+}
+
+func TestLogTailerPoll(t *testing.T) {
+	fl := &fakeLog{}
+	ts := httptest.NewServer(fl)
+	defer ts.Close()
+	ctx := context.Background()
+	c, err := cstorage.NewClient(ctx, option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var lines []string
+	tail := newLogTailer(c, "logs", "1234", func(line string) { lines = append(lines, line) })
+	for _, appended := range []string{"", "Step #0: a\nStep #0", ": b\n", "", "done"} {
+		fl.data += appended
+		if err := tail.poll(ctx); err != nil {
+			t.Fatalf("poll after %q: %v", fl.data, err)
+		}
+	}
+	tail.flush()
+	want := []string{"Step #0: a", "Step #0: b", "done"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+}
+
+func TestLogTailerFinish(t *testing.T) {
+	defer func(d time.Duration) { logSettleDelay = d }(logSettleDelay)
+	logSettleDelay = 0
+
+	// The log grows by a line with each of the first reads after the build
+	// is done, as when Cloud Build writes its last lines late.
+	fl := &fakeLog{data: "Step #0: a\n"}
+	late := []string{"Step #0: b\n", "DONE"}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fl.ServeHTTP(w, r)
+		if len(late) > 0 {
+			fl.data += late[0]
+			late = late[1:]
+		}
+	}))
+	defer ts.Close()
+	ctx := context.Background()
+	c, err := cstorage.NewClient(ctx, option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var lines []string
+	tail := newLogTailer(c, "logs", "1234", func(line string) { lines = append(lines, line) })
+	if err := tail.finish(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Step #0: a", "Step #0: b", "DONE"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+}
+
+func TestSplitStepLine(t *testing.T) {
+	for _, tt := range []struct {
+		line, step, text string
+		ok               bool
+	}{
+		{`Step #1 - "test": ok ./...`, "test", "ok ./...", true},
+		{`Step #2: Pushing`, "#2", "Pushing", true},
+		{`Starting Step #0`, "", "", false},
+		{`Step #3 - "x: y`, "", "", false},
+	} {
+		step, text, ok := splitStepLine(tt.line)
+		if step != tt.step || text != tt.text || ok != tt.ok {
+			t.Errorf("splitStepLine(%q) = %q, %q, %v; want %q, %q, %v", tt.line, step, text, ok, tt.step, tt.text, tt.ok)
+		}
+	}
+}
@@ -8,136 +8,140 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 
 	cstorage "cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	cloudbuild "google.golang.org/api/cloudbuild/v1"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
 	storage "google.golang.org/api/storage/v1"
 )
 
 var (
-	projectID = flag.String("project", "", "Project ID. Required.")
+	projectID = flag.String("project", "", "Project ID, or a comma-separated list of projects to build in concurrently. Required.")
 	name      = flag.String("name", "", "Image name. Required.")
 )
 
 func main() {
-	flag.Parse()
+	if runCommand(os.Args[1:]) {
+		return
+	}
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 		flag.PrintDefaults()
+		printCommands()
+	}
+	if err := loadConfig(flag.CommandLine, configFile, os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	flag.Parse()
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
 	}
 	if *projectID == "" {
-		fmt.Fprintln(os.Stderr, "Missing 'project' flag.")
+		logger.Error("Missing 'project' flag.")
 		flag.Usage()
 		os.Exit(2)
 	}
 	if *name == "" {
-		fmt.Fprintln(os.Stderr, "Missing 'name' flag.")
+		logger.Error("Missing 'name' flag.")
+		flag.Usage()
+		os.Exit(2)
+	}
+	projects, err := splitProjects(*projectID)
+	if err != nil {
+		logger.Error(err.Error())
 		flag.Usage()
 		os.Exit(2)
 	}
-
-	stagingBucket := "cdbuild-" + *projectID
-	buildObject := fmt.Sprintf("build/%s-%s.tar.gz", *name, uuid.Must(uuid.NewV4()))
 
 	ctx := context.Background()
+	if err := setupTelemetry(ctx); err != nil {
+		fatal(logger, "Could not set up telemetry", err)
+	}
+	ctx, tel.root = tel.startPhase(ctx, "cdbuild", attribute.String("name", *name))
+
+	_, ph := tel.startPhase(ctx, "auth")
 	hc, err := google.DefaultClient(ctx, storage.CloudPlatformScope)
+	ph.end(err)
 	if err != nil {
-		log.Fatalf("Could not get authenticated HTTP client: %v", err)
+		fatal(logger, "Could not get authenticated HTTP client", err, "phase", "auth")
 	}
-
-	if err := setupBucket(ctx, hc, stagingBucket); err != nil {
-		if gerr, ok := err.(*googleapi.Error); ok {
-			if gerr.Code == 403 {
-				// HACK(cbro): storage returns a 403 if billing is not enabled.
-				log.Fatalf("Could not set up Cloud Storage bucket. It's possible billing is not enabled. Root cause: %v", err)
-			}
-		}
-		log.Fatalf("Could not set up buckets: %v", err)
+	traceHTTP(hc)
+	if err := setupRedaction(ctx, hc); err != nil {
+		fatal(logger, "Could not set up redaction", err)
 	}
 
-	log.Printf("Pushing code to gs://%s/%s", stagingBucket, buildObject)
-
-	if err := uploadTar(ctx, hc, stagingBucket, buildObject); err != nil {
-		log.Fatalf("Could not upload source: %v", err)
+	c, err := cstorage.NewClient(ctx, option.WithHTTPClient(hc))
+	if err != nil {
+		fatal(logger, "Could not make Cloud storage client", err)
+	}
+	defer c.Close()
+	if err := setupAudit(ctx, c, flag.CommandLine); err != nil {
+		fatal(logger, "Could not set up audit", err)
 	}
 
 	api, err := cloudbuild.New(hc)
 	if err != nil {
-		log.Fatalf("Could not get cloudbuild client: %v", err)
-	}
-	call := api.Projects.Builds.Create(*projectID, &cloudbuild.Build{
-		LogsBucket: stagingBucket,
-		Source: &cloudbuild.Source{
-			StorageSource: &cloudbuild.StorageSource{
-				Bucket: stagingBucket,
-				Object: buildObject,
-			},
-		},
-		Steps: []*cloudbuild.BuildStep{
-			{
-				Name: "gcr.io/cloud-builders/dockerizer",
-				Args: []string{"gcr.io/" + *projectID + "/" + *name},
-			},
-		},
-		Images: []string{"gcr.io/" + *projectID + "/" + *name},
-	})
-	op, err := call.Context(ctx).Do()
-	if err != nil {
-		if gerr, ok := err.(*googleapi.Error); ok {
-			if gerr.Code == 404 {
-				// HACK(cbro): the API does not return a good error if the API is not enabled.
-				fmt.Fprintln(os.Stderr, "Could not create build. It's likely the Cloud Container Builder API is not enabled.")
-				fmt.Fprintf(os.Stderr, "Go here to enable it: https://console.cloud.google.com/apis/api/cloudbuild.googleapis.com/overview?project=%s\n", *projectID)
-				os.Exit(1)
-			}
-		}
-		log.Fatalf("Could not create build: %#v", err)
+		fatal(logger, "Could not get cloudbuild client", err)
 	}
-	remoteID, err := getBuildID(op)
+
+	_, ph = tel.startPhase(ctx, "package")
+	src, err := packageSource(*name, contexts())
+	ph.end(err)
 	if err != nil {
-		log.Fatalf("Could not get build ID from op: %v", err)
+		fatal(logger, "Could not package source", err, "phase", "package")
 	}
+	defer src.close()
 
-	log.Printf("Logs at https://console.cloud.google.com/m/cloudstorage/b/%s/o/log-%s.txt", stagingBucket, remoteID)
-
-	for {
-		b, err := api.Projects.Builds.Get(*projectID, remoteID).Do()
-		if err != nil {
-			log.Fatalf("Could not get build status: %v", err)
-		}
-
-		if b.Status != "WORKING" && b.Status != "QUEUED" {
-			log.Printf("Build status: %v", b.Status)
-			break
+	// Build in every project at once, sharing the packaged source.
+	builds := make([]*projectBuild, len(projects))
+	for i, p := range projects {
+		label := ""
+		if len(projects) > 1 {
+			label = p
 		}
-
-		time.Sleep(time.Second)
+		builds[i] = newProjectBuild(p, *name, label, src)
 	}
+	failed := runBuilds(ctx, hc, c, api, builds)
+	if failed > 0 {
+		fatal(logger, fmt.Sprintf("Build failed in %d of %d projects", failed, len(builds)), nil)
+	}
+	tel.root.end(nil)
+	shutdownTelemetry()
+}
 
-	c, err := cstorage.NewClient(ctx)
+// createBuild submits req in project and returns the ID of the new build.
+func createBuild(ctx context.Context, api *cloudbuild.Service, project string, req *cloudbuild.Build) (string, error) {
+	op, err := api.Projects.Builds.Create(project, req).Context(ctx).Do()
 	if err != nil {
-		log.Fatalf("Could not make Cloud storage client: %v", err)
+		return "", err
 	}
-	defer c.Close()
-	if err := c.Bucket(stagingBucket).Object(buildObject).Delete(ctx); err != nil {
-		log.Fatalf("Could not delete source tar.gz: %v", err)
+	id, err := getBuildID(op)
+	if err != nil {
+		return "", fmt.Errorf("could not get build ID from op: %v", err)
 	}
-	log.Print("Cleaned up.")
+	return id, nil
 }
 
 func getBuildID(op *cloudbuild.Operation) (string, error) {
@@ -151,7 +155,98 @@ func getBuildID(op *cloudbuild.Operation) (string, error) {
 	return build.Id, nil
 }
 
-func setupBucket(ctx context.Context, hc *http.Client, bucket string) error {
+// waitForBuild polls the build with the given ID until it is no longer
+// queued or running, and returns its final state. If tail is non-nil, the
+// build log is followed while waiting.
+func waitForBuild(ctx context.Context, api *cloudbuild.Service, project, id string, tail *logTailer) (*cloudbuild.Build, error) {
+	for {
+		b, err := api.Projects.Builds.Get(project, id).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		done := b.Status != "WORKING" && b.Status != "QUEUED"
+		if tail != nil {
+			read := tail.poll
+			if done {
+				read = tail.finish
+			}
+			if err := read(ctx); err != nil {
+				return nil, fmt.Errorf("could not read build log: %v", err)
+			}
+		}
+		if done {
+			return b, nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// splitProjects returns the projects in the comma-separated -project list.
+// Several projects cannot be built with -mirror, as each project's build
+// would push to the same mirrors.
+func splitProjects(list string) ([]string, error) {
+	var projects []string
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		switch {
+		case p == "":
+			return nil, fmt.Errorf("invalid -project %q: empty project ID", list)
+		case seen[p]:
+			return nil, fmt.Errorf("invalid -project %q: %s is given more than once", list, p)
+		}
+		seen[p] = true
+		projects = append(projects, p)
+	}
+	if len(projects) > 1 && len(mirrors) > 0 {
+		return nil, errors.New("-mirror cannot be used with several projects, as every project's build would push to the same mirrors")
+	}
+	return projects, nil
+}
+
+// buildSteps returns the steps that build and tag image.
+func buildSteps(image string) []*cloudbuild.BuildStep {
+	if len(extraContexts) == 0 && !hasBuildSecrets() && !*goCache {
+		return []*cloudbuild.BuildStep{
+			{
+				Name: "gcr.io/cloud-builders/dockerizer",
+				Args: []string{image},
+			},
+		}
+	}
+	// Named contexts, secrets and the Go cache mounts need BuildKit, which
+	// the dockerizer does not use.
+	args := append([]string{"buildx", "build", "-t", image}, buildContextArgs()...)
+	step := &cloudbuild.BuildStep{
+		Name: "gcr.io/cloud-builders/docker",
+		Args: append(args, "."),
+		Env:  []string{"DOCKER_BUILDKIT=1"},
+	}
+	addBuildSecrets(step)
+	if len(extraContexts) == 0 {
+		return []*cloudbuild.BuildStep{step}
+	}
+	mv, vol := moveContextsStep()
+	step.Volumes = append(step.Volumes, vol)
+	return []*cloudbuild.BuildStep{mv, step}
+}
+
+// stringsFlag implements flag.Value for flags that may be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// sourceRetentionDays is how long the staging bucket keeps source tarballs
+// left behind by builds that were interrupted.
+const sourceRetentionDays = 7
+
+// setupBucket creates bucket in project if it does not already exist.
+func setupBucket(ctx context.Context, hc *http.Client, project, bucket string) error {
 	s, err := storage.New(hc)
 	if err != nil {
 		return err
@@ -167,56 +262,164 @@ func setupBucket(ctx context.Context, hc *http.Client, bucket string) error {
 	} else {
 		return nil
 	}
-	_, err = s.Buckets.Insert(*projectID, &storage.Bucket{
-		Name: bucket,
-	}).Do()
+	b := &storage.Bucket{Name: bucket}
+	hardenBucket(b)
+	call := s.Buckets.Insert(project, b)
+	if *auditSink == "bucket" {
+		// Object retention lets -audit lock the audit records it writes. It
+		// cannot be turned off again, so it is only enabled when needed.
+		call = call.EnableObjectRetention(true)
+	}
+	_, err = call.Do()
 	return err
 }
 
-func uploadTar(ctx context.Context, hc *http.Client, bucket string, objectName string) error {
-	c, err := cstorage.NewClient(ctx)
+// hardenBucket changes the settings of the staging bucket b that cdbuild
+// relies on, and returns a description of each change. The bucket is not
+// public, access is controlled by IAM alone, and stray source tarballs are
+// deleted.
+func hardenBucket(b *storage.Bucket) []string {
+	var changes []string
+	if b.IamConfiguration == nil {
+		b.IamConfiguration = &storage.BucketIamConfiguration{}
+	}
+	ic := b.IamConfiguration
+	if ic.UniformBucketLevelAccess == nil || !ic.UniformBucketLevelAccess.Enabled {
+		ic.UniformBucketLevelAccess = &storage.BucketIamConfigurationUniformBucketLevelAccess{Enabled: true}
+		changes = append(changes, "enable uniform bucket-level access")
+	}
+	if ic.PublicAccessPrevention != "enforced" {
+		ic.PublicAccessPrevention = "enforced"
+		changes = append(changes, "enforce public access prevention")
+	}
+	if b.Lifecycle == nil {
+		b.Lifecycle = &storage.BucketLifecycle{}
+	}
+	for _, r := range b.Lifecycle.Rule {
+		if r.Action != nil && r.Action.Type == "Delete" && r.Condition != nil && len(r.Condition.MatchesPrefix) == 1 && r.Condition.MatchesPrefix[0] == "build/" {
+			return changes
+		}
+	}
+	age := int64(sourceRetentionDays)
+	b.Lifecycle.Rule = append(b.Lifecycle.Rule, &storage.BucketLifecycleRule{
+		Action:    &storage.BucketLifecycleRuleAction{Type: "Delete"},
+		Condition: &storage.BucketLifecycleRuleCondition{Age: &age, MatchesPrefix: []string{"build/"}},
+	})
+	changes = append(changes, fmt.Sprintf("delete source tarballs after %d days", sourceRetentionDays))
+	return changes
+}
+
+// source is a packaged build source. It is uploaded at most once to each
+// staging bucket, however many builds use it, and deleted once the last of
+// them is done.
+type source struct {
+	name string // Used in object names.
+	file *os.File
+	hash string // Content hash of the files; see writeSource.
+
+	mu      sync.Mutex
+	uploads map[string]*upload // By bucket.
+}
+
+// upload is a source's object in one staging bucket.
+type upload struct {
+	once   sync.Once
+	object string
+	size   int64
+	err    error
+	refs   int // Builds using the object.
+}
+
+// packageSource writes the build contexts ctxs to a temporary gzipped
+// tarball, which close removes. Objects uploaded from it are named after name.
+func packageSource(name string, ctxs []buildContext) (*source, error) {
+	f, err := ioutil.TempFile("", "cdbuild-*.tar.gz")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer c.Close()
+	hash, err := writeSource(f, ctxs)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &source{name: name, file: f, hash: hash, uploads: make(map[string]*upload)}, nil
+}
 
-	w := c.Bucket(bucket).Object(objectName).NewWriter(ctx)
+// writeSource writes the build contexts ctxs to w as a gzipped tarball, and
+// returns a hash of the files' names, modes and contents. Unlike a hash of
+// the tarball, it does not change with modification times, so it is the same
+// for every build of the same files.
+func writeSource(w io.Writer, ctxs []buildContext) (string, error) {
+	if err := checkContextsDir(ctxs); err != nil {
+		return "", err
+	}
 	gzw := gzip.NewWriter(w)
 	tw := tar.NewWriter(gzw)
-
-	if err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
-		if path == "." {
-			return nil
+	h := sha256.New()
+	for _, bc := range ctxs {
+		if err := writeContext(tw, h, bc); err != nil {
+			return "", err
 		}
-		hdr, err := tar.FileInfoHeader(info, "")
-		if err != nil {
-			return err
-		}
-		hdr.Name = path
-		if err := tw.WriteHeader(hdr); err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		f, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		_, err = io.Copy(tw, f)
-		return err
-	}); err != nil {
-		w.CloseWithError(err)
-		return err
 	}
 	if err := tw.Close(); err != nil {
-		w.CloseWithError(err)
-		return err
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), gzw.Close()
+}
+
+func (s *source) close() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// acquire uploads the source to bucket, unless another build already has,
+// and returns the object's name and size. Each call must be matched by a call
+// to release once the build has been submitted and has finished.
+func (s *source) acquire(ctx context.Context, c *cstorage.Client, bucket string) (string, int64, error) {
+	s.mu.Lock()
+	u := s.uploads[bucket]
+	if u == nil {
+		u = &upload{object: fmt.Sprintf("build/%s-%s.tar.gz", s.name, uuid.Must(uuid.NewV4()))}
+		s.uploads[bucket] = u
+	}
+	u.refs++
+	s.mu.Unlock()
+
+	u.once.Do(func() {
+		u.size, u.err = s.uploadTo(ctx, c, bucket, u.object)
+	})
+	return u.object, u.size, u.err
+}
+
+// release deletes the source's object in bucket if no other build is using
+// it.
+func (s *source) release(ctx context.Context, c *cstorage.Client, bucket string) error {
+	s.mu.Lock()
+	u := s.uploads[bucket]
+	u.refs--
+	last := u.refs == 0
+	if last {
+		delete(s.uploads, bucket)
+	}
+	s.mu.Unlock()
+	if !last || u.err != nil {
+		return nil
 	}
-	if err := gzw.Close(); err != nil {
+	return c.Bucket(bucket).Object(u.object).Delete(ctx)
+}
+
+// uploadTo uploads the source to the named object, returning its size.
+func (s *source) uploadTo(ctx context.Context, c *cstorage.Client, bucket, objectName string) (int64, error) {
+	r := io.NewSectionReader(s.file, 0, 1<<62)
+	w := c.Bucket(bucket).Object(objectName).NewWriter(ctx)
+	w.ContentType = "application/gzip"
+	if _, err := io.Copy(w, r); err != nil {
 		w.CloseWithError(err)
-		return err
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
 	}
-	return w.Close()
+	return w.Attrs().Size, nil
 }
@@ -0,0 +1,33 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitProjects(t *testing.T) {
+	for _, tt := range []struct {
+		list    string
+		mirrors stringsFlag
+		want    []string
+	}{
+		{list: "a", want: []string{"a"}},
+		{list: "a, b", want: []string{"a", "b"}},
+		{list: "a", mirrors: stringsFlag{"eu.gcr.io/a/hello"}, want: []string{"a"}},
+		{list: "a,"},
+		{list: ",a"},
+		{list: "a,a"},
+		{list: "a,b", mirrors: stringsFlag{"eu.gcr.io/a/hello"}},
+	} {
+		mirrors = tt.mirrors
+		got, err := splitProjects(tt.list)
+		if (err != nil) != (tt.want == nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitProjects(%q) with mirrors %q = %q, %v; want %q", tt.list, tt.mirrors, got, err, tt.want)
+		}
+	}
+	mirrors = nil
+}
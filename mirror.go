@@ -0,0 +1,111 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+var mirrors stringsFlag
+
+func init() {
+	flag.Var(&mirrors, "mirror", "Image to copy the built image to after a successful build, e.g. eu.gcr.io/project/name. The tag defaults to that of the built image. May be repeated.")
+}
+
+// mirrorResult is the outcome of copying the built image to one mirror.
+type mirrorResult struct {
+	dest   string
+	digest string
+	stats  copyStats
+	err    error
+}
+
+// mirrorTargets returns the references that image is mirrored to.
+func mirrorTargets(image string) ([]imageRef, error) {
+	src, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+	var refs []imageRef
+	for _, m := range mirrors {
+		r, err := parseImageRef(m)
+		if err != nil {
+			return nil, err
+		}
+		if _, tag := splitTag(m); tag == "" && !strings.Contains(m, "@") {
+			r.ref = src.ref
+		}
+		refs = append(refs, r)
+	}
+	return refs, nil
+}
+
+// builtDigest returns the digest that build b reported for image.
+func builtDigest(b *cloudbuild.Build, image string) (string, error) {
+	if b.Results != nil {
+		repo, _ := splitTag(image)
+		for _, bi := range b.Results.Images {
+			if bi.Name == image || bi.Name == repo {
+				return bi.Digest, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("build did not report a digest for %s", image)
+}
+
+// mirrorImage copies the image built by b to each mirror, and checks that
+// each copy has the same digest.
+func mirrorImage(ctx context.Context, rc *registryClient, b *cloudbuild.Build, image string) ([]*mirrorResult, error) {
+	digest, err := builtDigest(b, image)
+	if err != nil {
+		return nil, err
+	}
+	src, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+	src = src.withRef(digest)
+	targets, err := mirrorTargets(image)
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy to the mirrors concurrently.
+	results := make([]*mirrorResult, len(targets))
+	var wg sync.WaitGroup
+	for i, dst := range targets {
+		res := &mirrorResult{dest: dst.String(), stats: make(copyStats)}
+		results[i] = res
+		wg.Add(1)
+		go func(dst imageRef) {
+			defer wg.Done()
+			logger.Info("Mirroring image", "phase", "mirror", "build_id", b.Id, "image", image, "mirror", res.dest)
+			res.digest, res.err = rc.copyImage(ctx, src, dst, res.stats)
+			if res.err == nil && res.digest != digest {
+				res.err = fmt.Errorf("digest mismatch: built %s, mirror has %s", digest, res.digest)
+			}
+		}(dst)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func printMirrors(w io.Writer, results []*mirrorResult) {
+	fmt.Fprintln(w, "Mirrors:")
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(w, "  FAIL  %s: %v\n", r.dest, r.err)
+			continue
+		}
+		fmt.Fprintf(w, "  ok    %s@%s (blobs: %s)\n", r.dest, r.digest, r.stats)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	policyFile  = flag.String("policy", "", "Policy file that the Dockerfile, build request and images are checked against before the build is submitted.")
+	policyAudit = flag.Bool("policy-audit", false, "Report policy violations without failing the build.")
+)
+
+// policy is a set of rules that builds must satisfy. Image patterns may
+// contain "*", which matches any sequence of characters.
+type policy struct {
+	// AllowedBaseImages are patterns that each FROM image must match.
+	AllowedBaseImages []string `yaml:"allowedBaseImages"`
+	// AllowedRegistries are registry or repository prefixes, such as
+	// gcr.io/my-project, that target images must be pushed to.
+	AllowedRegistries []string `yaml:"allowedRegistries"`
+	// AllowedBuilders are patterns that each build step's image must match.
+	AllowedBuilders []string `yaml:"allowedBuilders"`
+	// RequiredLabels must be set by a LABEL instruction in the Dockerfile.
+	RequiredLabels []string `yaml:"requiredLabels"`
+	// ForbidLatest rejects target images tagged "latest" or not tagged.
+	ForbidLatest bool `yaml:"forbidLatestTag"`
+	// ForbidLatestProjects are patterns, such as *-prod, that limit
+	// ForbidLatest to builds in matching projects.
+	ForbidLatestProjects []string `yaml:"forbidLatestTagProjects"`
+
+	// The patterns above, compiled by readPolicy.
+	baseImages, builders, latestProjects globs
+}
+
+// enforcePolicy checks the named Dockerfile and req against the policy in
+// file, logging any violations. Unless -policy-audit is set, it returns an
+// error if there are violations.
+func enforcePolicy(file, dockerfile, project string, req *cloudbuild.Build) error {
+	p, err := readPolicy(file)
+	if err != nil {
+		return err
+	}
+	df, err := readDockerfile(dockerfile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read Dockerfile: %v", err)
+	}
+	v := p.check(df, project, req)
+	for _, s := range v {
+		logger.Warn("Policy violation", "phase", "policy", "policy", file, "violation", s)
+	}
+	if len(v) == 0 || *policyAudit {
+		return nil
+	}
+	return fmt.Errorf("build violates policy %s (%d violations)", file, len(v))
+}
+
+func readPolicy(name string) (*policy, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p := &policy{}
+	if err := yaml.UnmarshalStrict(b, p); err != nil {
+		return nil, fmt.Errorf("could not parse policy %s: %v", name, err)
+	}
+	if len(p.ForbidLatestProjects) > 0 && !p.ForbidLatest {
+		return nil, fmt.Errorf("policy %s: forbidLatestTagProjects is set without forbidLatestTag", name)
+	}
+	p.baseImages = compileGlobs(p.AllowedBaseImages)
+	p.builders = compileGlobs(p.AllowedBuilders)
+	p.latestProjects = compileGlobs(p.ForbidLatestProjects)
+	return p, nil
+}
+
+// check returns a description of each way in which the build violates the
+// policy. The target images are those built by req in project, any mirrors,
+// and the image's -promote tags. df may be nil if the build has no Dockerfile.
+func (p *policy) check(df *dockerfile, project string, req *cloudbuild.Build) []string {
+	var v []string
+	if df != nil {
+		if len(p.AllowedBaseImages) > 0 {
+			for _, s := range df.baseImages() {
+				if !p.baseImages.match(s.base) {
+					v = append(v, fmt.Sprintf("Dockerfile:%d: base image %q is not allowed", s.line, s.base))
+				}
+			}
+		}
+		for _, l := range p.RequiredLabels {
+			if _, ok := df.labels[l]; !ok {
+				v = append(v, fmt.Sprintf("Dockerfile: required label %q is not set", l))
+			}
+		}
+	}
+	if len(p.AllowedBuilders) > 0 {
+		for i, s := range req.Steps {
+			if !p.builders.match(s.Name) {
+				v = append(v, fmt.Sprintf("step #%d: builder image %q is not allowed", i, s.Name))
+			}
+		}
+	}
+	targets := append([]string(nil), req.Images...)
+	if len(req.Images) > 0 {
+		refs, err := mirrorTargets(req.Images[0])
+		if err != nil {
+			v = append(v, err.Error())
+		}
+		for _, r := range refs {
+			targets = append(targets, r.String())
+		}
+		// The -promote tags are added to the built image.
+		repo, _ := splitTag(req.Images[0])
+		for _, t := range promoteTags {
+			targets = append(targets, repo+":"+t)
+		}
+	}
+	forbidLatest := p.ForbidLatest && (len(p.latestProjects) == 0 || p.latestProjects.match(project))
+	for _, img := range targets {
+		if len(p.AllowedRegistries) > 0 && !hasRegistryPrefix(p.AllowedRegistries, img) {
+			v = append(v, fmt.Sprintf("image %q is not in an allowed registry", img))
+		}
+		if forbidLatest {
+			if _, tag := splitTag(img); tag == "" || tag == "latest" {
+				v = append(v, fmt.Sprintf("image %q must have a tag other than \"latest\"", img))
+			}
+		}
+	}
+	return v
+}
+
+// splitTag splits an image reference into its repository and tag. The tag
+// is empty if the reference has none.
+func splitTag(img string) (repo, tag string) {
+	if i := strings.Index(img, "@"); i >= 0 {
+		img = img[:i]
+	}
+	i := strings.LastIndex(img, ":")
+	if i < 0 || strings.Contains(img[i:], "/") {
+		return img, ""
+	}
+	return img[:i], img[i+1:]
+}
+
+func hasRegistryPrefix(registries []string, img string) bool {
+	for _, r := range registries {
+		if strings.HasPrefix(img, strings.TrimSuffix(r, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// globs are compiled patterns, in which "*" matches any sequence of
+// characters.
+type globs []*regexp.Regexp
+
+func compileGlobs(patterns []string) globs {
+	g := make(globs, len(patterns))
+	for i, p := range patterns {
+		g[i] = regexp.MustCompile("^" + strings.Replace(regexp.QuoteMeta(p), `\*`, ".*", -1) + "$")
+	}
+	return g
+}
+
+// match reports whether s matches any of the patterns.
+func (g globs) match(s string) bool {
+	for _, re := range g {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
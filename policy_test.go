@@ -0,0 +1,65 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "policy.yaml")
+	err := ioutil.WriteFile(name, []byte(`
+allowedBaseImages: ["golang:1.*"]
+allowedBuilders: ["gcr.io/cloud-builders/*"]
+forbidLatestTag: true
+forbidLatestTagProjects: ["*-prod"]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := readPolicy(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := parseDockerfile(strings.NewReader("FROM golang:1.22 AS build\nFROM alpine\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &cloudbuild.Build{
+		Steps:  []*cloudbuild.BuildStep{{Name: "gcr.io/cloud-builders/docker"}},
+		Images: []string{"gcr.io/app-prod/hello:latest"},
+	}
+	for _, tt := range []struct {
+		project string
+		want    []string
+	}{
+		{"app-dev", []string{`Dockerfile:2: base image "alpine" is not allowed`}},
+		{"app-prod", []string{
+			`Dockerfile:2: base image "alpine" is not allowed`,
+			`image "gcr.io/app-prod/hello:latest" must have a tag other than "latest"`,
+		}},
+	} {
+		got := p.check(df, tt.project, req)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("check in %s = %q, want %q", tt.project, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyCheckPromoteTags(t *testing.T) {
+	defer func(tags stringsFlag) { promoteTags = tags }(promoteTags)
+	promoteTags = stringsFlag{"prod", "latest"}
+	p := &policy{ForbidLatest: true, AllowedRegistries: []string{"gcr.io/p"}}
+	req := &cloudbuild.Build{Images: []string{"gcr.io/p/app:v1"}}
+	want := []string{`image "gcr.io/p/app:latest" must have a tag other than "latest"`}
+	if got := p.check(nil, "p", req); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("check = %q, want %q", got, want)
+	}
+}
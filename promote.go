@@ -0,0 +1,64 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+var promoteTags stringsFlag
+
+func init() {
+	flag.Var(&promoteTags, "promote", "Tag to add to the built image once it has passed -image-spec and -scan, e.g. prod. May be repeated.")
+}
+
+// promotion is the outcome of adding the promotion tags to the built image.
+type promotion struct {
+	tags     []string // Images that were tagged.
+	withheld string   // Why the tags were not added, if they were not.
+}
+
+// promoteImage adds each of tags to the image built by b, by uploading its
+// manifest under each tag.
+func promoteImage(ctx context.Context, rc *registryClient, b *cloudbuild.Build, image string, tags []string) ([]string, error) {
+	digest, err := builtDigest(b, image)
+	if err != nil {
+		return nil, err
+	}
+	src, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+	m, mediaType, _, err := rc.getManifest(ctx, src.withRef(digest))
+	if err != nil {
+		return nil, err
+	}
+	var done []string
+	for _, t := range tags {
+		dst := src.withRef(t)
+		logger.Info("Promoting image", "phase", "promote", "build_id", b.Id, "image", image, "tag", dst.String())
+		if _, err := rc.putManifest(ctx, dst, mediaType, m); err != nil {
+			return done, fmt.Errorf("could not tag %s: %v", dst, err)
+		}
+		done = append(done, dst.String())
+	}
+	return done, nil
+}
+
+func (p *promotion) print(w io.Writer) {
+	if p.withheld != "" {
+		fmt.Fprintf(w, "Promotion withheld: %s\n", p.withheld)
+		return
+	}
+	fmt.Fprintln(w, "Promoted:")
+	for _, t := range p.tags {
+		fmt.Fprintf(w, "  %s\n", t)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var redactPatterns = flag.String("redact-patterns", "", "YAML file listing regular expressions of secrets to redact from build logs and cdbuild's own logs, in addition to the built-in credential formats.")
+
+// redacted replaces each secret that is redacted.
+const redacted = "REDACTED"
+
+// defaultRedactPatterns match common credential formats.
+var defaultRedactPatterns = []string{
+	`AKIA[0-9A-Z]{16}`,               // AWS access key ID
+	`AIza[0-9A-Za-z_\-]{35}`,         // Google API key
+	`ya29\.[0-9A-Za-z_\-]{20,}`,      // Google OAuth access token
+	`gh[pousr]_[0-9A-Za-z]{36,}`,     // GitHub token
+	`github_pat_[0-9A-Za-z_]{22,}`,   // GitHub fine-grained token
+	`glpat-[0-9A-Za-z_\-]{20,}`,      // GitLab token
+	`xox[abposr]-[0-9A-Za-z\-]{10,}`, // Slack token
+	`sk_live_[0-9A-Za-z]{24,}`,       // Stripe secret key
+	`npm_[0-9A-Za-z]{36}`,            // npm token
+	`eyJ[0-9A-Za-z_\-]{10,}\.eyJ[0-9A-Za-z_\-]{10,}\.[0-9A-Za-z_\-]{10,}`, // JWT
+	// PEM private key, to its END line or the end of the text.
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----(?s:.*?)(?:-----END [A-Z ]*PRIVATE KEY-----|$)`,
+	`(?i)(authorization:\s*(bearer|basic)\s+)[^\s"']+`,
+}
+
+// minSecretLen is the length below which known secret values are not
+// redacted, as they would match too much unrelated output.
+const minSecretLen = 6
+
+// secretRedactor redacts secrets from cdbuild's output.
+var secretRedactor = newRedactor()
+
+// redactor replaces known secret values, and text matching patterns, with
+// REDACTED.
+type redactor struct {
+	mu       sync.RWMutex
+	values   []string // Longest first, so that no part of one is left.
+	patterns []*regexp.Regexp
+}
+
+func newRedactor() *redactor {
+	r := &redactor{}
+	for _, p := range defaultRedactPatterns {
+		r.patterns = append(r.patterns, regexp.MustCompile(p))
+	}
+	return r
+}
+
+// addPatterns adds the regular expressions in the YAML file name.
+func (r *redactor) addPatterns(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var patterns []string
+	if err := yaml.UnmarshalStrict(b, &patterns); err != nil {
+		return fmt.Errorf("could not parse %s: %v", name, err)
+	}
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		res = append(res, re)
+	}
+	r.mu.Lock()
+	r.patterns = append(r.patterns, res...)
+	r.mu.Unlock()
+	return nil
+}
+
+// addValue adds a secret value. As logs are redacted a line at a time, each
+// line of a multi-line value is also added.
+func (r *redactor) addValue(v string) {
+	values := []string{strings.TrimSpace(v)}
+	if strings.Contains(v, "\n") {
+		values = append(values, strings.Split(v, "\n")...)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if len(v) >= minSecretLen {
+			r.values = append(r.values, v)
+		}
+	}
+	sort.Slice(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+}
+
+// redact returns s with secrets replaced, and the number replaced.
+func (r *redactor) redact(s string) (string, int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n := 0
+	for _, v := range r.values {
+		if c := strings.Count(s, v); c > 0 {
+			n += c
+			s = strings.Replace(s, v, redacted, -1)
+		}
+	}
+	for _, re := range r.patterns {
+		s = re.ReplaceAllStringFunc(s, func(m string) string {
+			if strings.HasSuffix(m, redacted) {
+				// Already redacted by an earlier value or pattern.
+				return m
+			}
+			n++
+			// Keep the prefix of patterns with a group, such as the
+			// Authorization header's name.
+			if sub := re.FindStringSubmatch(m); len(sub) > 1 && sub[1] != "" {
+				return sub[1] + redacted
+			}
+			return redacted
+		})
+	}
+	return s, n
+}
+
+// privateKeyBegin and privateKeyEnd delimit the lines of a PEM private key.
+var (
+	privateKeyBegin = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+	privateKeyEnd   = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)
+)
+
+// logRedactor redacts the lines of a build log in order. Unlike redact, it
+// redacts every line of a private key, from its BEGIN line to its END line.
+type logRedactor struct {
+	inKey map[string]bool // By step, as steps may run at the same time.
+}
+
+func newLogRedactor() *logRedactor {
+	return &logRedactor{inKey: make(map[string]bool)}
+}
+
+// redact returns line with secrets replaced, and the number replaced. A
+// private key is counted once, on its BEGIN line.
+func (lr *logRedactor) redact(line string) (string, int) {
+	step, text, ok := splitStepLine(line)
+	if !ok {
+		text = line
+	}
+	prefix := line[:len(line)-len(text)]
+	if lr.inKey[step] {
+		loc := privateKeyEnd.FindStringIndex(text)
+		if loc == nil {
+			return prefix + redacted, 0
+		}
+		delete(lr.inKey, step)
+		rest, n := secretRedactor.redact(text[loc[1]:])
+		return prefix + redacted + rest, n
+	}
+	if loc := privateKeyBegin.FindStringIndex(text); loc != nil && !privateKeyEnd.MatchString(text[loc[1]:]) {
+		lr.inKey[step] = true
+	}
+	return secretRedactor.redact(line)
+}
+
+// redactAttr is a slog ReplaceAttr function that redacts secrets from
+// logged values.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if s, n := secretRedactor.redact(a.Value.String()); n > 0 {
+			a.Value = slog.StringValue(s)
+		}
+	case slog.KindAny:
+		if s, n := secretRedactor.redact(fmt.Sprint(a.Value.Any())); n > 0 {
+			a.Value = slog.StringValue(s)
+		}
+	}
+	return a
+}
+
+// setupRedaction reads the -redact-patterns file, and the values of the
+// -secret and -ssh secrets so that they are redacted should a build step
+// print them. Secrets that the caller cannot read are only redacted if they
+// match a pattern.
+func setupRedaction(ctx context.Context, hc *http.Client) error {
+	if *redactPatterns != "" {
+		if err := secretRedactor.addPatterns(*redactPatterns); err != nil {
+			return err
+		}
+	}
+	if !hasBuildSecrets() {
+		return nil
+	}
+	sm, err := secretmanager.NewService(ctx, option.WithHTTPClient(hc))
+	if err != nil {
+		return err
+	}
+	for _, f := range []*secretFlag{&buildSecrets, &sshKeys} {
+		for _, bs := range f.secrets {
+			resp, err := sm.Projects.Secrets.Versions.Access(bs.version).Context(ctx).Do()
+			if err != nil {
+				logger.Warn("Could not read secret to redact it from logs", "secret", bs.version, "error", err.Error())
+				continue
+			}
+			v, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+			if err != nil {
+				return fmt.Errorf("secret %s: %v", bs.version, err)
+			}
+			secretRedactor.addValue(string(v))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,496 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// Manifest media types that cdbuild asks registries for.
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// imageRef is a parsed image reference such as gcr.io/project/name:tag.
+type imageRef struct {
+	host string
+	repo string
+	ref  string // Tag or digest.
+}
+
+func (r imageRef) String() string {
+	if strings.HasPrefix(r.ref, "sha256:") {
+		return r.host + "/" + r.repo + "@" + r.ref
+	}
+	return r.host + "/" + r.repo + ":" + r.ref
+}
+
+// withRef returns a copy of r referring to the given tag or digest.
+func (r imageRef) withRef(ref string) imageRef {
+	r.ref = ref
+	return r
+}
+
+// parseImageRef parses an image reference. References without a tag or
+// digest refer to the "latest" tag.
+func parseImageRef(s string) (imageRef, error) {
+	var r imageRef
+	i := strings.Index(s, "/")
+	if i < 0 || !strings.ContainsAny(s[:i], ".:") {
+		return r, fmt.Errorf("image %q must include a registry host", s)
+	}
+	r.host, s = s[:i], s[i+1:]
+	if i := strings.Index(s, "@"); i >= 0 {
+		r.repo, r.ref = s[:i], s[i+1:]
+	} else {
+		r.repo, r.ref = splitTag(s)
+		if r.ref == "" {
+			r.ref = "latest"
+		}
+	}
+	if r.repo == "" {
+		return r, fmt.Errorf("image %q has no repository", s)
+	}
+	return r, nil
+}
+
+// manifest holds the parts of an image manifest or index that refer to
+// other content.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// registryClient talks to Docker Registry HTTP API v2 registries, using
+// Google credentials for authentication.
+type registryClient struct {
+	hc *http.Client
+	ts oauth2.TokenSource
+
+	mu     sync.Mutex
+	tokens map[string]string // Keyed by host and scope.
+}
+
+func newRegistryClient(ts oauth2.TokenSource) *registryClient {
+	return &registryClient{
+		hc:     &http.Client{Transport: tracingTransport{base: http.DefaultTransport}},
+		ts:     ts,
+		tokens: make(map[string]string),
+	}
+}
+
+// do sends a request to host with the given repository scopes, such as
+// "repository:project/name:pull", authenticating if challenged.
+func (c *registryClient) do(ctx context.Context, method, host, path string, body []byte, header http.Header, scopes ...string) (*http.Response, error) {
+	key := host + " " + strings.Join(scopes, " ")
+	for attempt := 0; ; attempt++ {
+		u := path
+		if !strings.HasPrefix(u, "https://") {
+			u = "https://" + host + path
+		}
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		c.mu.Lock()
+		tok := c.tokens[key]
+		c.mu.Unlock()
+		if tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		resp, err := c.hc.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		tok, err = c.token(ctx, challenge, scopes)
+		if err != nil {
+			return nil, fmt.Errorf("could not authenticate to %s: %v", host, err)
+		}
+		c.mu.Lock()
+		c.tokens[key] = tok
+		c.mu.Unlock()
+	}
+}
+
+// token obtains a bearer token for the given challenge and scopes, using
+// the Google access token as the password.
+func (c *registryClient) token(ctx context.Context, challenge string, scopes []string) (string, error) {
+	params := parseChallenge(challenge)
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	q := url.Values{}
+	if s := params["service"]; s != "" {
+		q.Set("service", s)
+	}
+	for _, s := range scopes {
+		q.Add("scope", s)
+	}
+	req, err := http.NewRequest("GET", realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	t, err := c.ts.Token()
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth("oauth2accesstoken", t.AccessToken)
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", registryError(resp)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+	if tr.Token != "" {
+		return tr.Token, nil
+	}
+	return tr.AccessToken, nil
+}
+
+// parseChallenge parses the parameters of a Bearer WWW-Authenticate header.
+func parseChallenge(h string) map[string]string {
+	params := make(map[string]string)
+	if !strings.HasPrefix(strings.ToLower(h), "bearer ") {
+		return params
+	}
+	for _, p := range strings.Split(h[len("bearer "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+// statusError is an unexpected response from a registry.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+func registryError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &statusError{
+		code: resp.StatusCode,
+		msg:  fmt.Sprintf("%s %s: %s: %s", resp.Request.Method, resp.Request.URL, resp.Status, bytes.TrimSpace(b)),
+	}
+}
+
+// isNotFound reports whether err is a registry's response that a manifest
+// or blob does not exist.
+func isNotFound(err error) bool {
+	e, ok := err.(*statusError)
+	return ok && e.code == http.StatusNotFound
+}
+
+func pullScope(r imageRef) string { return "repository:" + r.repo + ":pull" }
+func pushScope(r imageRef) string { return "repository:" + r.repo + ":pull,push" }
+
+// getManifest fetches the manifest that r refers to, returning its content,
+// media type and digest.
+func (c *registryClient) getManifest(ctx context.Context, r imageRef) ([]byte, string, string, error) {
+	h := http.Header{"Accept": manifestTypes}
+	resp, err := c.do(ctx, "GET", r.host, "/v2/"+r.repo+"/manifests/"+r.ref, nil, h, pullScope(r))
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", registryError(resp)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return b, resp.Header.Get("Content-Type"), digestOf(b), nil
+}
+
+// putManifest uploads a manifest to r, returning the digest reported by the
+// registry.
+func (c *registryClient) putManifest(ctx context.Context, r imageRef, mediaType string, b []byte) (string, error) {
+	h := http.Header{"Content-Type": {mediaType}}
+	resp, err := c.do(ctx, "PUT", r.host, "/v2/"+r.repo+"/manifests/"+r.ref, b, h, pushScope(r))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", registryError(resp)
+	}
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" {
+		return d, nil
+	}
+	return digestOf(b), nil
+}
+
+// deleteManifest removes the tag or manifest that r refers to.
+func (c *registryClient) deleteManifest(ctx context.Context, r imageRef) error {
+	resp, err := c.do(ctx, "DELETE", r.host, "/v2/"+r.repo+"/manifests/"+r.ref, nil, nil, pushScope(r))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return registryError(resp)
+	}
+	return nil
+}
+
+// getBlob returns the content of the blob with the given digest in r. It
+// holds the blob in memory, so is for small blobs such as image configs.
+func (c *registryClient) getBlob(ctx context.Context, r imageRef, digest string) ([]byte, error) {
+	rc, err := c.openBlob(ctx, r, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if got := digestOf(b); got != digest {
+		return nil, fmt.Errorf("blob %s has digest %s", digest, got)
+	}
+	return b, nil
+}
+
+// openBlob returns a reader of the blob with the given digest in r. Unlike
+// getBlob, it does not verify the digest.
+func (c *registryClient) openBlob(ctx context.Context, r imageRef, digest string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "GET", r.host, "/v2/"+r.repo+"/blobs/"+digest, nil, nil, pullScope(r))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, registryError(resp)
+	}
+	return resp.Body, nil
+}
+
+// blobSize returns the size of the blob with the given digest in r, or -1 if
+// it does not exist.
+func (c *registryClient) blobSize(ctx context.Context, r imageRef, digest string, scope string) (int64, error) {
+	resp, err := c.do(ctx, "HEAD", r.host, "/v2/"+r.repo+"/blobs/"+digest, nil, nil, scope)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return -1, nil
+	}
+	return 0, fmt.Errorf("HEAD %s: %s", resp.Request.URL, resp.Status)
+}
+
+// blob copy methods, as reported by copyBlob.
+const (
+	blobExisted = "existed"
+	blobMounted = "mounted"
+	blobCopied  = "copied"
+)
+
+// uploadChunkSize is the size of the chunks in which copyBlob uploads a
+// blob, and so the most of it that is held in memory.
+var uploadChunkSize = 16 << 20
+
+// copyBlob makes the blob with the given digest in src available in dst. If
+// both are on the same registry, it first asks the registry to mount the blob
+// from src, and otherwise, or if the registry cannot, it uploads it.
+func (c *registryClient) copyBlob(ctx context.Context, src, dst imageRef, digest string) (string, error) {
+	if n, err := c.blobSize(ctx, dst, digest, pushScope(dst)); err != nil {
+		return "", err
+	} else if n >= 0 {
+		return blobExisted, nil
+	}
+
+	path := "/v2/" + dst.repo + "/blobs/uploads/"
+	scopes := []string{pushScope(dst)}
+	if src.host == dst.host {
+		q := url.Values{"mount": {digest}, "from": {src.repo}}
+		path += "?" + q.Encode()
+		scopes = append(scopes, pullScope(src))
+	}
+	resp, err := c.do(ctx, "POST", dst.host, path, nil, nil, scopes...)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return blobMounted, nil
+	case http.StatusAccepted:
+		// An upload was started, in place of the mount if one was asked for.
+	default:
+		return "", registryError(resp)
+	}
+	loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	if err := c.uploadBlob(ctx, src, dst, digest, loc); err != nil {
+		return "", err
+	}
+	return blobCopied, nil
+}
+
+// uploadBlob streams the blob with the given digest from src to the upload
+// at loc in dst, a chunk at a time. The upload is only completed if what was
+// read from src has the digest.
+func (c *registryClient) uploadBlob(ctx context.Context, src, dst imageRef, digest string, loc *url.URL) error {
+	rc, err := c.openBlob(ctx, src, digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	r := io.TeeReader(rc, h)
+	buf := make([]byte, uploadChunkSize)
+	var offset int64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+		if n > 0 {
+			hdr := http.Header{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+int64(n)-1)},
+			}
+			resp, err := c.do(ctx, "PATCH", dst.host, loc.String(), buf[:n], hdr, pushScope(dst))
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusAccepted {
+				defer resp.Body.Close()
+				return registryError(resp)
+			}
+			resp.Body.Close()
+			if loc, err = resp.Request.URL.Parse(resp.Header.Get("Location")); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != digest {
+		return fmt.Errorf("blob %s has digest %s", digest, got)
+	}
+
+	q := loc.Query()
+	q.Set("digest", digest)
+	loc.RawQuery = q.Encode()
+	resp, err := c.do(ctx, "PUT", dst.host, loc.String(), nil, nil, pushScope(dst))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return registryError(resp)
+	}
+	return nil
+}
+
+// copyStats counts the blobs handled by copyImage, by copy method.
+type copyStats map[string]int
+
+func (s copyStats) String() string {
+	var parts []string
+	for k, n := range s {
+		parts = append(parts, fmt.Sprintf("%d %s", n, k))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// copyImage copies the image or image index that src refers to into dst,
+// including every blob and child manifest it refers to, and returns the
+// digest of the manifest at dst.
+func (c *registryClient) copyImage(ctx context.Context, src, dst imageRef, stats copyStats) (string, error) {
+	b, mediaType, _, err := c.getManifest(ctx, src)
+	if err != nil {
+		return "", err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return "", fmt.Errorf("could not parse manifest of %s: %v", src, err)
+	}
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+	for _, child := range m.Manifests {
+		if _, err := c.copyImage(ctx, src.withRef(child.Digest), dst.withRef(child.Digest), stats); err != nil {
+			return "", err
+		}
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	for _, d := range blobs {
+		how, err := c.copyBlob(ctx, src, dst, d.Digest)
+		if err != nil {
+			return "", err
+		}
+		stats[how]++
+	}
+	return c.putManifest(ctx, dst, mediaType, b)
+}
+
+// digestOf returns the sha256 digest of b.
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
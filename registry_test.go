@@ -0,0 +1,188 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// fakeRegistry is a stand-in for a Docker Registry HTTP API v2 registry,
+// without authentication.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte // Keyed by repo@digest.
+	manifests map[string][]byte // Keyed by repo:ref.
+	uploads   map[string]*bytes.Buffer
+	patches   int
+	mounts    int
+}
+
+func newFakeRegistry(t *testing.T) (*fakeRegistry, *httptest.Server) {
+	reg := &fakeRegistry{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+		uploads:   make(map[string]*bytes.Buffer),
+	}
+	ts := httptest.NewTLSServer(reg)
+	t.Cleanup(ts.Close)
+	return reg, ts
+}
+
+func (reg *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case strings.Contains(p, "/blobs/uploads/"):
+		i := strings.Index(p, "/blobs/uploads/")
+		repo, id := p[:i], p[i+len("/blobs/uploads/"):]
+		switch r.Method {
+		case "POST":
+			q := r.URL.Query()
+			if b, ok := reg.blobs[q.Get("from")+"@"+q.Get("mount")]; ok {
+				reg.blobs[repo+"@"+q.Get("mount")] = b
+				reg.mounts++
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			id := strconv.Itoa(len(reg.uploads))
+			reg.uploads[id] = new(bytes.Buffer)
+			w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+			w.WriteHeader(http.StatusAccepted)
+		case "PATCH":
+			buf := reg.uploads[id]
+			if r.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", buf.Len(), buf.Len()+len(body)-1) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			buf.Write(body)
+			reg.patches++
+			w.Header().Set("Location", r.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		case "PUT":
+			buf := reg.uploads[id]
+			buf.Write(body)
+			digest := r.URL.Query().Get("digest")
+			if digestOf(buf.Bytes()) != digest {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reg.blobs[repo+"@"+digest] = buf.Bytes()
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.Contains(p, "/blobs/"):
+		i := strings.LastIndex(p, "/blobs/")
+		b, ok := reg.blobs[p[:i]+"@"+p[i+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == "GET" {
+			w.Write(b)
+		}
+	case strings.Contains(p, "/manifests/"):
+		i := strings.LastIndex(p, "/manifests/")
+		key := p[:i] + ":" + p[i+len("/manifests/"):]
+		if r.Method == "PUT" {
+			reg.manifests[key] = body
+			reg.manifests[p[:i]+":"+digestOf(body)] = body
+			w.Header().Set("Docker-Content-Digest", digestOf(body))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		b, ok := reg.manifests[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(reg.manifests, key)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Write(b)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// addImage adds an image with the given config and layer to repo, tagged
+// tag, and returns the digest of its manifest.
+func (reg *fakeRegistry) addImage(repo, tag string, config, layer []byte) string {
+	m := fmt.Sprintf(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"digest": %q, "size": %d}, "layers": [{"digest": %q, "size": %d}]}`,
+		digestOf(config), len(config), digestOf(layer), len(layer))
+	reg.blobs[repo+"@"+digestOf(config)] = config
+	reg.blobs[repo+"@"+digestOf(layer)] = layer
+	reg.manifests[repo+":"+tag] = []byte(m)
+	reg.manifests[repo+":"+digestOf([]byte(m))] = []byte(m)
+	return digestOf([]byte(m))
+}
+
+func testRegistryClient(ts *httptest.Server) *registryClient {
+	return &registryClient{hc: ts.Client(), tokens: make(map[string]string)}
+}
+
+func TestCopyImage(t *testing.T) {
+	defer func(n int) { uploadChunkSize = n }(uploadChunkSize)
+	uploadChunkSize = 10
+
+	config, layer := []byte(`{"os": "linux"}`), bytes.Repeat([]byte("layer"), 5)
+	srcReg, srcTS := newFakeRegistry(t)
+	digest := srcReg.addImage("p/app", "v1", config, layer)
+	srcHost := strings.TrimPrefix(srcTS.URL, "https://")
+	src := imageRef{host: srcHost, repo: "p/app", ref: digest}
+	ctx := context.Background()
+
+	// On the same registry, blobs are mounted.
+	stats := make(copyStats)
+	got, err := testRegistryClient(srcTS).copyImage(ctx, src, imageRef{host: srcHost, repo: "q/app", ref: "v1"}, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != digest || stats[blobMounted] != 2 || srcReg.patches != 0 {
+		t.Errorf("same registry: digest %s, stats %v, %d patches; want %s, 2 mounted, 0 patches", got, stats, srcReg.patches, digest)
+	}
+
+	// Between registries, blobs are uploaded in chunks.
+	dstReg, dstTS := newFakeRegistry(t)
+	rc := testRegistryClient(srcTS)
+	rc.hc = dstTS.Client() // Trusts both servers' certificate.
+	stats = make(copyStats)
+	got, err = rc.copyImage(ctx, src, imageRef{host: strings.TrimPrefix(dstTS.URL, "https://"), repo: "p/app", ref: "v1"}, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 25 bytes of layer and 15 of config, in chunks of 10.
+	if got != digest || stats[blobCopied] != 2 || dstReg.patches != 5 {
+		t.Errorf("between registries: digest %s, stats %v, %d patches; want %s, 2 copied, 5 patches", got, stats, dstReg.patches, digest)
+	}
+	if !bytes.Equal(dstReg.blobs["p/app@"+digestOf(layer)], layer) {
+		t.Error("layer was not copied intact")
+	}
+
+	// A blob that does not match its digest is not committed.
+	srcReg.blobs["p/app@"+digestOf(layer)] = []byte("corrupt")
+	_, err = rc.copyImage(ctx, src, imageRef{host: strings.TrimPrefix(dstTS.URL, "https://"), repo: "r/app", ref: "v1"}, make(copyStats))
+	if err == nil || !strings.Contains(err.Error(), "has digest") {
+		t.Errorf("copy of corrupt blob: got error %v, want digest mismatch", err)
+	}
+	if _, ok := dstReg.blobs["r/app@"+digestOf(layer)]; ok {
+		t.Error("corrupt blob was committed")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+var (
+	retries    = flag.Int("retries", 0, "Number of times to resubmit a build that fails for a transient, infrastructure-related reason.")
+	retryDelay = flag.Duration("retry-delay", 30*time.Second, "Delay before resubmitting a build that failed for a transient reason.")
+)
+
+// transientFailure reports whether build b failed for a reason unrelated to
+// its steps, such that resubmitting it may succeed, and describes the reason.
+// A step that runs and fails is never considered transient.
+func transientFailure(b *cloudbuild.Build) (reason string, ok bool) {
+	switch b.Status {
+	case "INTERNAL_ERROR":
+		return "internal error", true
+	case "FAILURE":
+	default:
+		return "", false
+	}
+	if fi := b.FailureInfo; fi != nil {
+		switch fi.Type {
+		case "FETCH_SOURCE_FAILED", "LOGGING_FAILURE", "PUSH_FAILED":
+			return fmt.Sprintf("%s: %s", fi.Type, fi.Detail), true
+		case "USER_BUILD_STEP":
+			return "", false
+		}
+	}
+	for i, s := range b.Steps {
+		// A step whose builder image was being pulled but that never
+		// started running failed to pull its image.
+		if s.Status == "FAILURE" && s.PullTiming != nil && s.Timing == nil {
+			return fmt.Sprintf("could not pull builder image %s for step #%d", s.Name, i), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,269 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	containeranalysis "google.golang.org/api/containeranalysis/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	serviceusage "google.golang.org/api/serviceusage/v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	scanImage     = flag.Bool("scan", false, "Wait for Container Analysis to scan the built image for vulnerabilities, and gate -promote tags on the results.")
+	scanSeverity  = flag.String("scan-severity", "HIGH", "Lowest vulnerability severity that fails the scan: LOW, MEDIUM, HIGH or CRITICAL.")
+	scanAllowlist = flag.String("scan-allowlist", "", "YAML file listing vulnerability IDs, such as CVE-2023-1234, that do not fail the scan.")
+	scanAction    = flag.String("scan-action", "fail", "What to do if the scan fails: fail, or withhold to skip the -promote tags but exit successfully.")
+	scanTimeout   = flag.Duration("scan-timeout", 10*time.Minute, "How long to wait for scan results.")
+	scanEndpoint  = flag.String("scan-endpoint", "", "Container Analysis API endpoint, e.g. for a stand-in server. Defaults to the production API.")
+)
+
+// severities ranks vulnerability severities.
+var severities = map[string]int{
+	"MINIMAL":  1,
+	"LOW":      2,
+	"MEDIUM":   3,
+	"HIGH":     4,
+	"CRITICAL": 5,
+}
+
+// scanResult summarizes the vulnerabilities found in the built image.
+type scanResult struct {
+	counts   map[string]int // By severity, excluding allowed findings.
+	allowed  int
+	findings []vulnFinding // At or above the -scan-severity threshold.
+}
+
+// vulnFinding is a vulnerability that fails the scan.
+type vulnFinding struct {
+	id       string
+	severity string
+	pkg      string
+	fixed    string // Version that fixes it, if there is one.
+}
+
+// checkScanFlags validates the -scan flags and reads the allowlist.
+func checkScanFlags() (map[string]bool, error) {
+	if _, ok := severities[*scanSeverity]; !ok {
+		return nil, fmt.Errorf("invalid -scan-severity %q", *scanSeverity)
+	}
+	if *scanAction != "fail" && *scanAction != "withhold" {
+		return nil, fmt.Errorf("invalid -scan-action %q", *scanAction)
+	}
+	allow := make(map[string]bool)
+	if *scanAllowlist == "" {
+		return allow, nil
+	}
+	b, err := ioutil.ReadFile(*scanAllowlist)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	if err := yaml.UnmarshalStrict(b, &ids); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", *scanAllowlist, err)
+	}
+	for _, id := range ids {
+		allow[id] = true
+	}
+	return allow, nil
+}
+
+// newContainerAnalysis returns a Container Analysis client that uses hc.
+func newContainerAnalysis(ctx context.Context, hc *http.Client) (*containeranalysis.Service, error) {
+	opts := []option.ClientOption{option.WithHTTPClient(hc)}
+	if *scanEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(*scanEndpoint))
+	}
+	return containeranalysis.NewService(ctx, opts...)
+}
+
+// scanningAPI is the API that scans images pushed to the registry. If it is
+// disabled, no scan ever starts.
+const scanningAPI = "containerscanning.googleapis.com"
+
+// checkScanningEnabled returns an error if the Container Scanning API is not
+// enabled in project, so that the build fails before it starts rather than
+// waiting for a scan until -scan-timeout. If the caller cannot see which APIs
+// are enabled, the scan is waited for as usual.
+func checkScanningEnabled(ctx context.Context, hc *http.Client, project string) error {
+	if *scanEndpoint != "" {
+		// A stand-in server has no Service Usage API.
+		return nil
+	}
+	su, err := serviceusage.NewService(ctx, option.WithHTTPClient(hc))
+	if err != nil {
+		return err
+	}
+	svc, err := su.Services.Get("projects/" + project + "/services/" + scanningAPI).Context(ctx).Do()
+	if err != nil {
+		logger.Debug("Could not check whether the Container Scanning API is enabled", "phase", "scan", "error", err.Error())
+		return nil
+	}
+	if svc.State != "ENABLED" {
+		return fmt.Errorf("the Container Scanning API (%s) is not enabled in project %s; enable it with cdbuild init -apply", scanningAPI, project)
+	}
+	return nil
+}
+
+// isServiceDisabled reports whether err is the error that Google APIs return
+// when the API is not enabled in the project.
+func isServiceDisabled(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, e := range gerr.Errors {
+		if e.Reason == "accessNotConfigured" {
+			return true
+		}
+	}
+	for _, d := range gerr.Details {
+		if m, ok := d.(map[string]interface{}); ok && m["reason"] == "SERVICE_DISABLED" {
+			return true
+		}
+	}
+	return false
+}
+
+// scanImageDigest waits for Container Analysis to finish scanning the image
+// with the given digest in project, and returns its findings.
+func scanImageDigest(ctx context.Context, ca *containeranalysis.Service, project, image, digest string, allow map[string]bool) (*scanResult, error) {
+	r, err := parseImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+	resource := "https://" + r.host + "/" + r.repo + "@" + digest
+	parent := "projects/" + project
+
+	deadline := time.Now().Add(*scanTimeout)
+	for {
+		status, err := scanStatus(ctx, ca, parent, resource)
+		if err != nil {
+			return nil, err
+		}
+		if status == "FINISHED_SUCCESS" || status == "COMPLETE" {
+			break
+		}
+		if status == "FINISHED_FAILED" || status == "FINISHED_UNSUPPORTED" {
+			return nil, fmt.Errorf("scan of %s did not complete: %s", resource, status)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out after %v waiting for scan of %s (status %q)", *scanTimeout, resource, status)
+		}
+		logger.Debug("Waiting for scan", "phase", "scan", "resource", resource, "status", status)
+		time.Sleep(5 * time.Second)
+	}
+
+	res := &scanResult{counts: make(map[string]int)}
+	threshold := severities[*scanSeverity]
+	filter := fmt.Sprintf(`kind="VULNERABILITY" AND resourceUrl=%q`, resource)
+	err = ca.Projects.Occurrences.List(parent).Filter(filter).Pages(ctx, func(resp *containeranalysis.ListOccurrencesResponse) error {
+		for _, o := range resp.Occurrences {
+			v := o.Vulnerability
+			if v == nil {
+				continue
+			}
+			id := path.Base(o.NoteName)
+			if allow[id] {
+				res.allowed++
+				continue
+			}
+			sev := v.EffectiveSeverity
+			if sev == "" || sev == "SEVERITY_UNSPECIFIED" {
+				sev = v.Severity
+			}
+			res.counts[sev]++
+			if severities[sev] < threshold {
+				continue
+			}
+			f := vulnFinding{id: id, severity: sev}
+			if len(v.PackageIssue) > 0 {
+				pi := v.PackageIssue[0]
+				f.pkg = pi.AffectedPackage
+				if pi.FixedVersion != nil && pi.FixedVersion.Kind == "NORMAL" {
+					f.fixed = pi.FixedVersion.Name
+				}
+			}
+			res.findings = append(res.findings, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res.findings, func(i, j int) bool {
+		a, b := res.findings[i], res.findings[j]
+		if a.severity != b.severity {
+			return severities[a.severity] > severities[b.severity]
+		}
+		return a.id < b.id
+	})
+	return res, nil
+}
+
+// scanStatus returns the analysis status of resource, or "" if scanning has
+// not started.
+func scanStatus(ctx context.Context, ca *containeranalysis.Service, parent, resource string) (string, error) {
+	filter := fmt.Sprintf(`kind="DISCOVERY" AND resourceUrl=%q`, resource)
+	resp, err := ca.Projects.Occurrences.List(parent).Filter(filter).Context(ctx).Do()
+	if isServiceDisabled(err) {
+		return "", fmt.Errorf("the Container Analysis API is not enabled in %s; enable it with gcloud services enable containeranalysis.googleapis.com: %v", parent, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, o := range resp.Occurrences {
+		if o.Discovery != nil {
+			return o.Discovery.AnalysisStatus, nil
+		}
+	}
+	return "", nil
+}
+
+// failed reports whether the scan found vulnerabilities at or above the
+// threshold.
+func (r *scanResult) failed() bool {
+	return len(r.findings) > 0
+}
+
+func (r *scanResult) print(w io.Writer) {
+	var counts []string
+	for _, sev := range []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "MINIMAL"} {
+		if n := r.counts[sev]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, strings.ToLower(sev)))
+		}
+	}
+	if len(counts) == 0 {
+		counts = []string{"no vulnerabilities"}
+	}
+	fmt.Fprintf(w, "Vulnerability scan: %s", strings.Join(counts, ", "))
+	if r.allowed > 0 {
+		fmt.Fprintf(w, " (%d allowed)", r.allowed)
+	}
+	fmt.Fprintln(w)
+	for _, f := range r.findings {
+		fmt.Fprintf(w, "  FAIL  %s (%s)", f.id, f.severity)
+		if f.pkg != "" {
+			fmt.Fprintf(w, " in %s", f.pkg)
+		}
+		if f.fixed != "" {
+			fmt.Fprintf(w, ", fixed in %s", f.fixed)
+		}
+		fmt.Fprintln(w)
+	}
+}
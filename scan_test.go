@@ -0,0 +1,128 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	containeranalysis "google.golang.org/api/containeranalysis/v1"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// fakeContainerAnalysis is a stand-in for the Container Analysis API that
+// serves a finished scan with the given vulnerability occurrences, or
+// serves err, a JSON error, with status code.
+type fakeContainerAnalysis struct {
+	vulns string
+	code  int
+	err   string
+}
+
+func (ca *fakeContainerAnalysis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if ca.code != 0 {
+		w.WriteHeader(ca.code)
+		w.Write([]byte(ca.err))
+		return
+	}
+	if r.URL.Path != "/v1/projects/my-project/occurrences" {
+		http.NotFound(w, r)
+		return
+	}
+	filter := r.URL.Query().Get("filter")
+	if !strings.Contains(filter, `resourceUrl="https://gcr.io/my-project/hello@`+testDigest+`"`) {
+		w.Write([]byte(`{}`))
+		return
+	}
+	if strings.Contains(filter, `kind="DISCOVERY"`) {
+		w.Write([]byte(`{"occurrences": [{"kind": "DISCOVERY", "discovery": {"analysisStatus": "FINISHED_SUCCESS"}}]}`))
+		return
+	}
+	w.Write([]byte(`{"occurrences": [` + ca.vulns + `]}`))
+}
+
+const (
+	criticalVuln = `{"kind": "VULNERABILITY", "noteName": "projects/goog-vulnz/notes/CVE-2023-0001",
+		"vulnerability": {"effectiveSeverity": "CRITICAL",
+		"packageIssue": [{"affectedPackage": "openssl", "fixedVersion": {"kind": "NORMAL", "name": "3.0.8"}}]}}`
+	lowVuln = `{"kind": "VULNERABILITY", "noteName": "projects/goog-vulnz/notes/CVE-2023-0002",
+		"vulnerability": {"severity": "LOW"}}`
+)
+
+// newFakeContainerAnalysis starts ca and returns a client of it.
+func newFakeContainerAnalysis(t *testing.T, ca *fakeContainerAnalysis) *containeranalysis.Service {
+	ts := httptest.NewServer(ca)
+	t.Cleanup(ts.Close)
+	defer func(e string) { *scanEndpoint = e }(*scanEndpoint)
+	*scanEndpoint = ts.URL
+	svc, err := newContainerAnalysis(context.Background(), ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func TestScanImageDigest(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		vulns    string
+		allow    map[string]bool
+		failed   bool
+		findings []vulnFinding
+		allowed  int
+	}{
+		{name: "pass", vulns: lowVuln},
+		{
+			name:     "fail",
+			vulns:    criticalVuln + "," + lowVuln,
+			failed:   true,
+			findings: []vulnFinding{{id: "CVE-2023-0001", severity: "CRITICAL", pkg: "openssl", fixed: "3.0.8"}},
+		},
+		{
+			name:    "allowlist",
+			vulns:   criticalVuln + "," + lowVuln,
+			allow:   map[string]bool{"CVE-2023-0001": true},
+			allowed: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ca := newFakeContainerAnalysis(t, &fakeContainerAnalysis{vulns: tt.vulns})
+			res, err := scanImageDigest(context.Background(), ca, "my-project", "gcr.io/my-project/hello:v1", testDigest, tt.allow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.failed() != tt.failed {
+				t.Errorf("failed() = %v, want %v", res.failed(), tt.failed)
+			}
+			if len(res.findings) != len(tt.findings) || (len(tt.findings) > 0 && res.findings[0] != tt.findings[0]) {
+				t.Errorf("findings = %+v, want %+v", res.findings, tt.findings)
+			}
+			if res.allowed != tt.allowed {
+				t.Errorf("allowed = %d, want %d", res.allowed, tt.allowed)
+			}
+			if res.counts["LOW"] != 1 {
+				t.Errorf("counts = %v, want 1 low", res.counts)
+			}
+		})
+	}
+}
+
+func TestScanImageDigestServiceDisabled(t *testing.T) {
+	ca := newFakeContainerAnalysis(t, &fakeContainerAnalysis{
+		code: http.StatusForbidden,
+		err: `{"error": {"code": 403, "status": "PERMISSION_DENIED",
+			"message": "Container Analysis API has not been used in project 1234 before or it is disabled.",
+			"details": [{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "SERVICE_DISABLED"}]}}`,
+	})
+	_, err := scanImageDigest(context.Background(), ca, "my-project", "gcr.io/my-project/hello:v1", testDigest, nil)
+	if err == nil || !strings.Contains(err.Error(), "not enabled") {
+		t.Fatalf("scanImageDigest error = %v, want API not enabled", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+// sshKeyDir is where the build step writes the -ssh keys. It is in the step's
+// own filesystem, not the workspace, so the keys are neither part of the
+// build context nor seen by other steps.
+const sshKeyDir = "/tmp/cdbuild-ssh"
+
+var (
+	buildSecrets = secretFlag{kind: "secret"}
+	sshKeys      = secretFlag{kind: "ssh", defaultID: "default"}
+)
+
+func init() {
+	flag.Var(&buildSecrets, "secret", "BuildKit secret for RUN --mount=type=secret, as id=name,sm=projects/P/secrets/S[/versions/V]. It is read from Secret Manager during the build. May be repeated.")
+	flag.Var(&sshKeys, "ssh", "SSH private key for RUN --mount=type=ssh, as [id=name,]sm=projects/P/secrets/S[/versions/V]. It is read from Secret Manager during the build, and the id defaults to \"default\". May be repeated.")
+}
+
+// buildSecret is a Secret Manager secret version made available to the
+// Dockerfile under id.
+type buildSecret struct {
+	id      string
+	version string // projects/P/secrets/S/versions/V
+}
+
+var secretVersion = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+(/versions/[^/]+)?$`)
+
+// secretFlag implements flag.Value for repeated -secret and -ssh flags.
+type secretFlag struct {
+	kind      string
+	defaultID string // If empty, the id is required.
+	secrets   []buildSecret
+}
+
+func (f *secretFlag) String() string {
+	var s []string
+	for _, bs := range f.secrets {
+		s = append(s, "id="+bs.id+",sm="+bs.version)
+	}
+	return strings.Join(s, " ")
+}
+
+func (f *secretFlag) Set(v string) error {
+	bs := buildSecret{id: f.defaultID}
+	for _, kv := range strings.Split(v, ",") {
+		switch {
+		case strings.HasPrefix(kv, "id="):
+			bs.id = strings.TrimPrefix(kv, "id=")
+		case strings.HasPrefix(kv, "sm="):
+			bs.version = strings.TrimPrefix(kv, "sm=")
+		default:
+			return fmt.Errorf("%s %q: unknown field %q", f.kind, v, kv)
+		}
+	}
+	switch {
+	case bs.id == "" || strings.ContainsAny(bs.id, "=, "):
+		return fmt.Errorf("%s %q must have an id", f.kind, v)
+	case !secretVersion.MatchString(bs.version):
+		return fmt.Errorf("%s %q must have sm=projects/P/secrets/S[/versions/V]", f.kind, v)
+	}
+	if !strings.Contains(bs.version, "/versions/") {
+		bs.version += "/versions/latest"
+	}
+	for _, o := range f.secrets {
+		if o.id == bs.id {
+			return fmt.Errorf("%s %q specified more than once", f.kind, bs.id)
+		}
+	}
+	f.secrets = append(f.secrets, bs)
+	return nil
+}
+
+// env returns the name of the environment variable that holds the i'th
+// secret in the build step.
+func (f *secretFlag) env(i int) string {
+	return fmt.Sprintf("CDBUILD_%s_%d", strings.ToUpper(f.kind), i)
+}
+
+// hasBuildSecrets reports whether any -secret or -ssh flags were given, which
+// need BuildKit.
+func hasBuildSecrets() bool {
+	return len(buildSecrets.secrets) > 0 || len(sshKeys.secrets) > 0
+}
+
+// availableSecrets returns the Secret Manager secrets that the build reads,
+// or nil if there are none.
+func availableSecrets() *cloudbuild.Secrets {
+	if !hasBuildSecrets() {
+		return nil
+	}
+	s := &cloudbuild.Secrets{}
+	for _, f := range []*secretFlag{&buildSecrets, &sshKeys} {
+		for i, bs := range f.secrets {
+			s.SecretManager = append(s.SecretManager, &cloudbuild.SecretManagerSecret{
+				VersionName: bs.version,
+				Env:         f.env(i),
+			})
+		}
+	}
+	return s
+}
+
+// addBuildSecrets changes step, a docker buildx build whose last argument is
+// the context, to use the -secret and -ssh secrets. Cloud Build puts them in
+// the step's environment; secrets are passed to BuildKit from there, and SSH
+// keys are first written to sshKeyDir, as BuildKit reads keys from files.
+// None of them is written to the workspace.
+func addBuildSecrets(step *cloudbuild.BuildStep) {
+	if !hasBuildSecrets() {
+		return
+	}
+	var args []string
+	for i, bs := range buildSecrets.secrets {
+		env := buildSecrets.env(i)
+		step.SecretEnv = append(step.SecretEnv, env)
+		args = append(args, "--secret", "id="+bs.id+",env="+env)
+	}
+	script := "set -e\numask 077\nmkdir -p " + sshKeyDir + "\n"
+	for i, bs := range sshKeys.secrets {
+		env := sshKeys.env(i)
+		step.SecretEnv = append(step.SecretEnv, env)
+		key := fmt.Sprintf("%s/%d", sshKeyDir, i)
+		script += fmt.Sprintf("printf '%%s\\n' \"$$%s\" > %s\n", env, key)
+		args = append(args, "--ssh", bs.id+"="+key)
+	}
+	n := len(step.Args)
+	step.Args = append(append(append([]string{}, step.Args[:n-1]...), args...), step.Args[n-1])
+	if len(sshKeys.secrets) == 0 {
+		return
+	}
+	// The keys must be written before docker runs, so run it from a script.
+	step.Entrypoint = "bash"
+	step.Args = append([]string{"-c", script + `exec docker "$$@"`, "docker"}, step.Args...)
+}
+
+// secretFlagsFromBuild returns the -secret and -ssh flags that produce the
+// secrets used by b.
+func secretFlagsFromBuild(b *cloudbuild.Build) (secrets, ssh []string) {
+	if b.AvailableSecrets == nil {
+		return nil, nil
+	}
+	versions := make(map[string]string)
+	for _, s := range b.AvailableSecrets.SecretManager {
+		versions[s.Env] = s.VersionName
+	}
+	for _, st := range b.Steps {
+		for i := 0; i+1 < len(st.Args); i++ {
+			switch st.Args[i] {
+			case "--secret":
+				// id=name,env=CDBUILD_SECRET_n
+				var id, env string
+				for _, kv := range strings.Split(st.Args[i+1], ",") {
+					if strings.HasPrefix(kv, "id=") {
+						id = strings.TrimPrefix(kv, "id=")
+					} else if strings.HasPrefix(kv, "env=") {
+						env = strings.TrimPrefix(kv, "env=")
+					}
+				}
+				if v, ok := versions[env]; ok {
+					secrets = append(secrets, "id="+id+",sm="+v)
+				}
+			case "--ssh":
+				// name=sshKeyDir/n
+				kv := strings.SplitN(st.Args[i+1], "=", 2)
+				if len(kv) != 2 || !strings.HasPrefix(kv[1], sshKeyDir+"/") {
+					continue
+				}
+				env := fmt.Sprintf("CDBUILD_SSH_%s", strings.TrimPrefix(kv[1], sshKeyDir+"/"))
+				if v, ok := versions[env]; ok {
+					ssh = append(ssh, "id="+kv[0]+",sm="+v)
+				}
+			}
+		}
+	}
+	return secrets, ssh
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+// smokeStepID is the ID of the build step that runs the smoke test.
+const smokeStepID = "smoke-test"
+
+var (
+	smokeTest    = flag.Bool("smoke-test", false, "Run the built image before it is pushed, and fail the build if it does not start.")
+	smokeCmd     = flag.String("smoke-cmd", "", "Arguments to run the image with during the smoke test, split on spaces. Defaults to the image's own command.")
+	smokePort    = flag.Int("smoke-port", 8080, "Port that the image listens on during the smoke test. Also passed to it as $PORT.")
+	smokePath    = flag.String("smoke-path", "/", "Path that must return a 2xx response during the smoke test. If empty, the container only has to keep running.")
+	smokeTimeout = flag.Duration("smoke-timeout", 30*time.Second, "How long the smoke test waits for the health check to pass, or for the container to keep running if -smoke-path is empty.")
+)
+
+// smokeScript starts the image, waits for it to become healthy, and prints
+// its output. The container is on the cloudbuild network, so the health
+// check reaches it by name. Dollar signs are doubled so that Cloud Build does
+// not treat them as substitutions.
+const smokeScript = `docker run -d --name cdbuild-smoke --network cloudbuild -e PORT=$$SMOKE_PORT "$$SMOKE_IMAGE" "$$@" > /dev/null || exit 1
+running() { [ "$$(docker inspect -f '{{.State.Running}}' cdbuild-smoke)" = true ]; }
+status=1
+if [ -z "$$SMOKE_PATH" ]; then
+  sleep "$$SMOKE_TIMEOUT"
+  if running; then status=0; fi
+else
+  end=$$(awk -v now="$$(date +%s%3N)" -v t="$$SMOKE_TIMEOUT" 'BEGIN { printf "%d", now + t * 1000 }')
+  while running && [ "$$(date +%s%3N)" -lt "$$end" ]; do
+    if docker run --rm --network cloudbuild busybox wget -q -T 5 -O /dev/null "http://cdbuild-smoke:$$SMOKE_PORT$$SMOKE_PATH"; then
+      status=0
+      break
+    fi
+    sleep 1
+  done
+fi
+if [ "$$status" -ne 0 ]; then
+  if running; then
+    echo "Smoke test failed: no 2xx response from $$SMOKE_PATH on port $$SMOKE_PORT within $${SMOKE_TIMEOUT}s."
+  else
+    echo "Smoke test failed: container exited with status $$(docker inspect -f '{{.State.ExitCode}}' cdbuild-smoke)."
+  fi
+fi
+echo "Container output:"
+docker logs cdbuild-smoke 2>&1
+docker rm -f cdbuild-smoke > /dev/null
+exit $$status`
+
+// smokeSteps returns the step that smoke tests image, or nil if it was not
+// requested. It must follow the steps that build the image, which leave it in
+// the build's docker daemon; Cloud Build only pushes images once every step
+// has succeeded.
+func smokeSteps(image string) []*cloudbuild.BuildStep {
+	if !*smokeTest {
+		return nil
+	}
+	return []*cloudbuild.BuildStep{
+		{
+			Id:         smokeStepID,
+			Name:       "gcr.io/cloud-builders/docker",
+			Entrypoint: "bash",
+			Args:       append([]string{"-c", smokeScript, smokeStepID}, strings.Fields(*smokeCmd)...),
+			Env: []string{
+				"SMOKE_IMAGE=" + image,
+				"SMOKE_PORT=" + strconv.Itoa(*smokePort),
+				"SMOKE_PATH=" + *smokePath,
+				"SMOKE_TIMEOUT=" + formatSeconds(*smokeTimeout),
+			},
+		},
+	}
+}
+
+// formatSeconds returns d as a decimal number of seconds, such as 30 or 1.5,
+// exactly.
+func formatSeconds(d time.Duration) string {
+	s := strconv.FormatInt(int64(d/time.Second), 10)
+	if ns := d % time.Second; ns != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%09d", ns), "0")
+	}
+	return s
+}
+
+// stepStatus returns the status of the step of build b with the given ID, or
+// "" if there is no such step.
+func stepStatus(b *cloudbuild.Build, id string) string {
+	for _, s := range b.Steps {
+		if s.Id == id {
+			return s.Status
+		}
+	}
+	return ""
+}
+
+func printSmoke(w io.Writer, status string) {
+	switch status {
+	case "SUCCESS":
+		fmt.Fprintln(w, "Smoke test: passed")
+	case "FAILURE", "TIMEOUT":
+		fmt.Fprintln(w, "Smoke test: FAILED (see the smoke-test step in the build log)")
+	default:
+		fmt.Fprintln(w, "Smoke test: not run")
+	}
+}
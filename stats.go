@@ -0,0 +1,271 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+// buildStats summarizes the history of builds of an image.
+type buildStats struct {
+	Image       string       `json:"image"`
+	Builds      int          `json:"builds"`
+	Succeeded   int          `json:"succeeded"`
+	SuccessRate float64      `json:"successRate"`
+	Queue       percentiles  `json:"queue"`
+	Duration    percentiles  `json:"duration"`
+	Steps       []*stepStats `json:"steps"`
+	Flaky       []flakyStep  `json:"flaky"`
+
+	durations durationSample
+	queue     durationSample
+}
+
+// stepStats summarizes the runs of a single build step.
+type stepStats struct {
+	Step     string      `json:"step"`
+	Runs     int         `json:"runs"`
+	Failures int         `json:"failures"`
+	Duration percentiles `json:"duration"`
+	sample   durationSample
+}
+
+// flakyStep is a step that both passed and failed for the same source.
+type flakyStep struct {
+	Step    string `json:"step"`
+	Sources int    `json:"sources"` // Number of sources for which it flipped.
+}
+
+type percentiles struct {
+	P50, P95 time.Duration
+}
+
+// MarshalJSON encodes the percentiles in seconds.
+func (p percentiles) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		P50 float64 `json:"p50Seconds"`
+		P95 float64 `json:"p95Seconds"`
+	}{p.P50.Seconds(), p.P95.Seconds()})
+}
+
+type durationSample []time.Duration
+
+// percentiles returns the 50th and 95th percentiles of s, by nearest rank.
+func (s durationSample) percentiles() percentiles {
+	if len(s) == 0 {
+		return percentiles{}
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	rank := func(p float64) time.Duration {
+		i := int(p*float64(len(s))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(s) {
+			i = len(s) - 1
+		}
+		return s[i]
+	}
+	return percentiles{P50: rank(0.50), P95: rank(0.95)}
+}
+
+func statsCmd(args []string) {
+	fs := commandFlags("stats", "")
+	image := fs.String("image", "", "Image to analyze, with or without a tag. Required.")
+	since := fs.String("since", "30d", "Analyze builds created within this period, e.g. 30d or 12h.")
+	format := fs.String("format", "table", "Output format: table or json.")
+	parseCommandFlags(fs, args)
+	if *image == "" {
+		logger.Error("Missing 'image' flag.")
+		fs.Usage()
+		os.Exit(2)
+	}
+	age, err := parseAge(*since)
+	if err != nil {
+		logger.Error("Invalid -since", "error", err.Error())
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	_, api, err := newCloudBuild(ctx)
+	if err != nil {
+		fatal(logger, "Could not create client", err)
+	}
+
+	st := &buildStats{Image: *image}
+	steps := make(map[string]*stepStats)
+	// outcomes records, per source and step, whether the step passed and
+	// whether it failed.
+	outcomes := make(map[string]map[string]*[2]bool)
+	err = listBuilds(ctx, api, time.Now().Add(-age), "", func(b *cloudbuild.Build) {
+		if !buildsImage(b, *image) || b.Status == "QUEUED" || b.Status == "WORKING" {
+			return
+		}
+		st.Builds++
+		if b.Status == "SUCCESS" {
+			st.Succeeded++
+		}
+		if d, ok := timeSpan(b.CreateTime, b.StartTime); ok {
+			st.queue = append(st.queue, d)
+		}
+		if d, ok := buildDuration(b); ok {
+			st.durations = append(st.durations, d)
+		}
+		src := sourceKey(b)
+		for i, s := range b.Steps {
+			id := stepName(i, s)
+			ss, ok := steps[id]
+			if !ok {
+				ss = &stepStats{Step: id}
+				steps[id] = ss
+				st.Steps = append(st.Steps, ss)
+			}
+			if s.Status != "SUCCESS" && s.Status != "FAILURE" {
+				continue
+			}
+			ss.Runs++
+			if s.Status == "FAILURE" {
+				ss.Failures++
+			}
+			if s.Timing != nil {
+				if d, ok := timeSpan(s.Timing.StartTime, s.Timing.EndTime); ok {
+					ss.sample = append(ss.sample, d)
+				}
+			}
+			if src == "" {
+				continue
+			}
+			if outcomes[src] == nil {
+				outcomes[src] = make(map[string]*[2]bool)
+			}
+			o := outcomes[src][id]
+			if o == nil {
+				o = new([2]bool)
+				outcomes[src][id] = o
+			}
+			if s.Status == "SUCCESS" {
+				o[0] = true
+			} else {
+				o[1] = true
+			}
+		}
+	})
+	if err != nil {
+		fatal(logger, "Could not list builds", err)
+	}
+
+	if st.Builds > 0 {
+		st.SuccessRate = float64(st.Succeeded) / float64(st.Builds)
+	}
+	st.Queue = st.queue.percentiles()
+	st.Duration = st.durations.percentiles()
+	for _, ss := range st.Steps {
+		ss.Duration = ss.sample.percentiles()
+	}
+	flips := make(map[string]int)
+	for _, bySteps := range outcomes {
+		for id, o := range bySteps {
+			if o[0] && o[1] {
+				flips[id]++
+			}
+		}
+	}
+	for _, ss := range st.Steps {
+		if n := flips[ss.Step]; n > 0 {
+			st.Flaky = append(st.Flaky, flakyStep{Step: ss.Step, Sources: n})
+		}
+	}
+
+	switch *format {
+	case "table":
+		err = st.print(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(st)
+	default:
+		logger.Error("Invalid -format", "format", *format)
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(logger, "Could not write report", err)
+	}
+}
+
+// buildsImage reports whether b pushes image. If image has no tag, any tag
+// matches.
+func buildsImage(b *cloudbuild.Build, image string) bool {
+	for _, img := range b.Images {
+		if img == image {
+			return true
+		}
+		if repo, _ := splitTag(img); repo == image {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceTagPrefix prefixes the build tag that holds the content hash of the
+// source that cdbuild uploaded.
+const sourceTagPrefix = "source-"
+
+// sourceKey identifies the source that b was built from, or returns "" if it
+// is unknown. Builds submitted by cdbuild are tagged with a hash of their
+// files; builds from a repository have its commit.
+func sourceKey(b *cloudbuild.Build) string {
+	for _, t := range b.Tags {
+		if strings.HasPrefix(t, sourceTagPrefix) {
+			return t
+		}
+	}
+	if sp := b.SourceProvenance; sp != nil && sp.ResolvedRepoSource != nil && sp.ResolvedRepoSource.CommitSha != "" {
+		return sp.ResolvedRepoSource.CommitSha
+	}
+	return ""
+}
+
+// stepName identifies a step by its ID if it has one, or its position and
+// builder image otherwise.
+func stepName(i int, s *cloudbuild.BuildStep) string {
+	if s.Id != "" {
+		return s.Id
+	}
+	return fmt.Sprintf("#%d %s", i, s.Name)
+}
+
+func (st *buildStats) print(w io.Writer) error {
+	fmt.Fprintf(w, "Image:        %s\n", st.Image)
+	fmt.Fprintf(w, "Builds:       %d (%.0f%% succeeded)\n", st.Builds, st.SuccessRate*100)
+	fmt.Fprintf(w, "Queue time:   p50 %v, p95 %v\n", st.Queue.P50.Round(time.Second), st.Queue.P95.Round(time.Second))
+	fmt.Fprintf(w, "Duration:     p50 %v, p95 %v\n\n", st.Duration.P50.Round(time.Second), st.Duration.P95.Round(time.Second))
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tRUNS\tFAILED\tP50\tP95")
+	for _, ss := range st.Steps {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\n", ss.Step, ss.Runs, ss.Failures,
+			ss.Duration.P50.Round(time.Second), ss.Duration.P95.Round(time.Second))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(st.Flaky) > 0 {
+		fmt.Fprintln(w, "\nFlaky steps (both passed and failed for the same source):")
+		for _, f := range st.Flaky {
+			fmt.Fprintf(w, "  %s (%d sources)\n", f.Step, f.Sources)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+func TestSourceKey(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		b    *cloudbuild.Build
+		want string
+	}{
+		{"tag", &cloudbuild.Build{Tags: []string{"team-a", "source-abc123"}}, "source-abc123"},
+		{"commit", &cloudbuild.Build{SourceProvenance: &cloudbuild.SourceProvenance{
+			ResolvedRepoSource: &cloudbuild.RepoSource{CommitSha: "deadbeef"},
+		}}, "deadbeef"},
+		{"unknown", &cloudbuild.Build{SourceProvenance: &cloudbuild.SourceProvenance{
+			FileHashes: map[string]cloudbuild.FileHashes{"gs://b/build/x.tar.gz": {FileHash: []*cloudbuild.Hash{{Type: "SHA256", Value: "xyz"}}}},
+		}}, ""},
+	} {
+		if got := sourceKey(tt.b); got != tt.want {
+			t.Errorf("%s: sourceKey = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPercentilesJSON(t *testing.T) {
+	b, err := json.Marshal(percentiles{P50: 90 * time.Second, P95: 2500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"p50Seconds":90,"p95Seconds":2.5}`; string(b) != want {
+		t.Errorf("json = %s, want %s", b, want)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// summary is the report printed once a build has finished.
+type summary struct {
+	tests     *testReport
+	goCache   *goCacheInfo
+	mirrors   []*mirrorResult
+	smoke     string // Status of the smoke test step, if one was run.
+	spec      *specResult
+	scan      *scanResult
+	promotion *promotion
+	approval  *approval
+	// redactions is the number of secrets redacted from the streamed log.
+	redactions int
+}
+
+func (s *summary) print(w io.Writer) {
+	if s.tests != nil && !s.tests.empty() {
+		fmt.Fprintln(w, "Test results:")
+		s.tests.print(w)
+	}
+	if *smokeTest {
+		printSmoke(w, s.smoke)
+	}
+	if s.spec != nil {
+		s.spec.print(w)
+	}
+	if s.scan != nil {
+		s.scan.print(w)
+	}
+	if s.approval != nil {
+		s.approval.print(w)
+	}
+	if s.promotion != nil {
+		s.promotion.print(w)
+	}
+	if s.goCache != nil {
+		s.goCache.print(w)
+	}
+	if len(s.mirrors) > 0 {
+		printMirrors(w, s.mirrors)
+	}
+	if s.redactions > 0 {
+		fmt.Fprintf(w, "Redacted %d secrets from the build log.\n", s.redactions)
+	}
+}
+
+// failedMirrors returns the number of mirrors that the image could not be
+// copied to.
+func (s *summary) failedMirrors() int {
+	n := 0
+	for _, m := range s.mirrors {
+		if m.err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// specFailed reports whether the image did not meet the image spec.
+func (s *summary) specFailed() bool {
+	return s.spec != nil && len(s.spec.violations) > 0
+}
+
+// scanFailed reports whether the vulnerability scan failed.
+func (s *summary) scanFailed() bool {
+	return s.scan != nil && s.scan.failed()
+}
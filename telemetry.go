@@ -0,0 +1,197 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+var (
+	otelEndpoint = flag.String("otel-endpoint", "", "OTLP/HTTP endpoint URL, such as http://localhost:4318, to export traces and metrics to.")
+	otelFile     = flag.String("otel-file", "", "File to write traces and metrics to, as JSON.")
+)
+
+// traceSubstitution is the build substitution that carries the W3C trace
+// context of the cdbuild invocation into the build.
+const traceSubstitution = "_TRACEPARENT"
+
+// tel records traces and metrics for each phase of a build. It discards
+// everything unless -otel-endpoint or -otel-file is set.
+var tel = &telemetry{
+	tracer:   tracenoop.NewTracerProvider().Tracer(""),
+	meter:    metricnoop.NewMeterProvider().Meter(""),
+	shutdown: func(context.Context) error { return nil },
+}
+
+type telemetry struct {
+	tracer   trace.Tracer
+	meter    metric.Meter
+	duration metric.Float64Histogram
+	builds   metric.Int64Counter
+	shutdown func(context.Context) error
+
+	// root is the phase spanning the whole invocation, if started.
+	root *phase
+}
+
+// setupTelemetry configures tel to export to the destination given by the
+// -otel-endpoint or -otel-file flags.
+func setupTelemetry(ctx context.Context) error {
+	var (
+		spans   sdktrace.SpanExporter
+		metrics sdkmetric.Exporter
+		err     error
+	)
+	switch {
+	case *otelEndpoint != "":
+		spans, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(*otelEndpoint))
+		if err != nil {
+			return err
+		}
+		metrics, err = otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(*otelEndpoint))
+	case *otelFile != "":
+		var f *os.File
+		f, err = os.OpenFile(*otelFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		spans, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			return err
+		}
+		metrics, err = stdoutmetric.New(stdoutmetric.WithWriter(f))
+	default:
+		return tel.init()
+	}
+	if err != nil {
+		return err
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", "cdbuild"))
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spans), sdktrace.WithResource(res))
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metrics)), sdkmetric.WithResource(res))
+	tel.tracer = tp.Tracer("github.com/broady/cdbuild")
+	tel.meter = mp.Meter("github.com/broady/cdbuild")
+	tel.shutdown = func(ctx context.Context) error {
+		terr := tp.Shutdown(ctx)
+		if err := mp.Shutdown(ctx); err != nil {
+			return err
+		}
+		return terr
+	}
+	return tel.init()
+}
+
+func (t *telemetry) init() error {
+	var err error
+	t.duration, err = t.meter.Float64Histogram("cdbuild.phase.duration",
+		metric.WithDescription("Duration of each phase of a build."),
+		metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+	t.builds, err = t.meter.Int64Counter("cdbuild.builds",
+		metric.WithDescription("Number of builds, by final status."))
+	return err
+}
+
+// phase is a timed phase of a build.
+type phase struct {
+	name  string
+	span  trace.Span
+	start time.Time
+}
+
+// startPhase starts a span for the named phase as a child of any span in
+// ctx. The phase must be ended with end.
+func (t *telemetry) startPhase(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, *phase) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, &phase{name: name, span: span, start: time.Now()}
+}
+
+// end ends the phase, recording err on its span if non-nil.
+func (p *phase) end(err error, attrs ...attribute.KeyValue) {
+	p.span.SetAttributes(attrs...)
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+		p.span.RecordError(err)
+		p.span.SetStatus(codes.Error, err.Error())
+	}
+	p.span.End()
+	tel.duration.Record(context.Background(), time.Since(p.start).Seconds(),
+		metric.WithAttributes(attribute.String("phase", p.name), attribute.String("outcome", outcome)))
+}
+
+// recordRemotePhases adds spans for the time build b spent queued and
+// running, using the timestamps reported by Cloud Build.
+func (t *telemetry) recordRemotePhases(ctx context.Context, b *cloudbuild.Build) {
+	created, cerr := time.Parse(time.RFC3339Nano, b.CreateTime)
+	started, serr := time.Parse(time.RFC3339Nano, b.StartTime)
+	finished, ferr := time.Parse(time.RFC3339Nano, b.FinishTime)
+	attrs := []attribute.KeyValue{
+		attribute.String("build.id", b.Id),
+		attribute.String("build.status", b.Status),
+	}
+	record := func(name string, from, to time.Time) {
+		_, span := t.tracer.Start(ctx, name, trace.WithTimestamp(from), trace.WithAttributes(attrs...))
+		span.End(trace.WithTimestamp(to))
+		t.duration.Record(ctx, to.Sub(from).Seconds(),
+			metric.WithAttributes(attribute.String("phase", name), attribute.String("outcome", b.Status)))
+	}
+	if cerr == nil && serr == nil {
+		record("queue", created, started)
+	}
+	if serr == nil && ferr == nil {
+		record("run", started, finished)
+	}
+	t.builds.Add(ctx, 1, metric.WithAttributes(attribute.String("build.status", b.Status)))
+}
+
+// propagateTrace passes the trace context in ctx to the build as the
+// _TRACEPARENT substitution, which is also exposed to each step as the
+// TRACEPARENT environment variable.
+func propagateTrace(ctx context.Context, req *cloudbuild.Build) {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	tp := carrier.Get("traceparent")
+	if tp == "" {
+		return
+	}
+	if req.Substitutions == nil {
+		req.Substitutions = make(map[string]string)
+	}
+	req.Substitutions[traceSubstitution] = tp
+	for _, s := range req.Steps {
+		s.Env = append(s.Env, "TRACEPARENT=$"+traceSubstitution)
+	}
+}
+
+func shutdownTelemetry() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tel.shutdown(ctx); err != nil {
+		logger.Warn("Could not export telemetry", "error", err.Error())
+	}
+}
@@ -0,0 +1,521 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	cstorage "cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"golang.org/x/term"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	topRefresh    = 2 * time.Second
+	topMaxRefresh = time.Minute
+	topLogLines   = 1000
+)
+
+// topView is the screen shown by cdbuild top.
+type topView int
+
+const (
+	viewList topView = iota
+	viewDetails
+	viewLogs
+)
+
+// topUI is the state of the cdbuild top terminal UI.
+type topUI struct {
+	api *cloudbuild.Service
+	gcs *cstorage.Client
+
+	builds   []*cloudbuild.Build
+	selected string // ID of the selected build.
+	view     topView
+	message  string
+	confirm  bool // Waiting for confirmation to cancel the selected build.
+
+	log  *topLog // Log of the selected build, in the log view.
+	logs []string
+}
+
+// topLog is the log of a build shown by cdbuild top. It is polled in the
+// background, one poll at a time.
+type topLog struct {
+	tail  *logTailer
+	lines []string // Read by the current poll.
+}
+
+func newTopLog(gcs *cstorage.Client, b *cloudbuild.Build) *topLog {
+	l := &topLog{}
+	lr := newLogRedactor()
+	l.tail = newLogTailer(gcs, strings.TrimPrefix(b.LogsBucket, "gs://"), b.Id, func(line string) {
+		line, _ = lr.redact(line)
+		l.lines = append(l.lines, line)
+	})
+	return l
+}
+
+func topCmd(args []string) {
+	fs := commandFlags("top", "")
+	for _, name := range []string{"redact-patterns", "secret", "ssh"} {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	parseCommandFlags(fs, args)
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		logger.Error("cdbuild top must be run in a terminal.")
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	hc, api, err := newCloudBuild(ctx)
+	if err != nil {
+		fatal(logger, "Could not create client", err)
+	}
+	if err := setupRedaction(ctx, hc); err != nil {
+		fatal(logger, "Could not set up redaction", err)
+	}
+	gcs, err := cstorage.NewClient(ctx, option.WithHTTPClient(hc))
+	if err != nil {
+		fatal(logger, "Could not make Cloud storage client", err)
+	}
+	defer gcs.Close()
+
+	old, err := term.MakeRaw(fd)
+	if err != nil {
+		fatal(logger, "Could not put terminal into raw mode", err)
+	}
+	// Hold log output, such as traced HTTP requests, while the UI owns the
+	// terminal, and write it out once the terminal is restored.
+	var held bytes.Buffer
+	logger = newLogger(&held)
+	// Use the alternate screen, and hide the cursor.
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(fd, old)
+		logger = newLogger(os.Stderr)
+		os.Stderr.Write(held.Bytes())
+	}()
+
+	ui := &topUI{api: api, gcs: gcs}
+	ui.run(ctx, readKeys(os.Stdin))
+}
+
+// Keys that are not single printable characters.
+const (
+	keyUp    = "up"
+	keyDown  = "down"
+	keyEnter = "enter"
+	keyEsc   = "esc"
+)
+
+// readKeys reads key presses from r and sends them on the returned channel.
+func readKeys(r *os.File) <-chan string {
+	keys := make(chan string)
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			b, err := br.ReadByte()
+			if err != nil {
+				close(keys)
+				return
+			}
+			switch b {
+			case '\r', '\n':
+				keys <- keyEnter
+			case 3: // Ctrl-C
+				keys <- "q"
+			case 0x1b:
+				if br.Buffered() >= 2 {
+					seq := make([]byte, 2)
+					br.Read(seq)
+					switch string(seq) {
+					case "[A":
+						keys <- keyUp
+					case "[B":
+						keys <- keyDown
+					}
+					continue
+				}
+				keys <- keyEsc
+			default:
+				keys <- string(b)
+			}
+		}
+	}()
+	return keys
+}
+
+// fetched is the result of fetching the builds to show.
+type fetched struct {
+	builds []*cloudbuild.Build
+	err    error
+}
+
+// polled is the result of polling a log.
+type polled struct {
+	log   *topLog
+	lines []string
+	err   error
+}
+
+func (ui *topUI) run(ctx context.Context, keys <-chan string) {
+	ctx, cancel := context.WithCancel(ctx)
+	refresh := time.NewTimer(0)
+	interval := topRefresh
+	logTick := time.NewTicker(time.Second)
+	defer logTick.Stop()
+
+	// Builds are fetched in the background, so that keys are handled while
+	// the API is slow. The next fetch starts once the last one is done.
+	results := make(chan fetched)
+	fetching := false
+	// So is the log, which may be polled after it is no longer shown.
+	logs := make(chan polled)
+	polling := false
+	poll := func() {
+		l := ui.log
+		if polling || ui.view != viewLogs || l == nil {
+			return
+		}
+		polling = true
+		go func() {
+			err := l.tail.poll(ctx)
+			lines := l.lines
+			l.lines = nil
+			logs <- polled{l, lines, err}
+		}()
+	}
+	defer func() {
+		cancel()
+		if fetching {
+			<-results
+		}
+		if polling {
+			<-logs
+		}
+	}()
+
+	for {
+		select {
+		case k, ok := <-keys:
+			l := ui.log
+			if !ok || !ui.handleKey(ctx, k) {
+				return
+			}
+			if ui.log != l {
+				poll()
+			}
+		case <-refresh.C:
+			selected := ""
+			if ui.view != viewList {
+				selected = ui.selected
+			}
+			fetching = true
+			go func() {
+				builds, err := ui.fetch(ctx, selected)
+				results <- fetched{builds, err}
+			}()
+			continue
+		case r := <-results:
+			fetching = false
+			if r.err != nil {
+				// Back off while the API is failing.
+				interval *= 2
+				if interval > topMaxRefresh {
+					interval = topMaxRefresh
+				}
+				ui.message = fmt.Sprintf("Could not list builds: %v (retrying in %v)", r.err, interval)
+			} else {
+				ui.show(r.builds)
+				interval = topRefresh
+			}
+			refresh.Reset(interval)
+		case <-logTick.C:
+			poll()
+			continue
+		case r := <-logs:
+			polling = false
+			if r.log != ui.log {
+				// Another build was selected while the log was read.
+				poll()
+				continue
+			}
+			if r.err != nil {
+				ui.message = fmt.Sprintf("Could not read log: %v", r.err)
+			}
+			ui.logs = append(ui.logs, r.lines...)
+			if len(ui.logs) > topLogLines {
+				ui.logs = ui.logs[len(ui.logs)-topLogLines:]
+			}
+		}
+		ui.draw()
+	}
+}
+
+// fetch fetches the active builds, along with the build with ID selected,
+// if any, if it has since finished. It does not touch the UI's state, as it
+// runs in the background.
+func (ui *topUI) fetch(ctx context.Context, selected string) ([]*cloudbuild.Build, error) {
+	var builds []*cloudbuild.Build
+	err := ui.api.Projects.Builds.List(*projectID).Filter(`status="WORKING" OR status="QUEUED"`).Pages(ctx, func(resp *cloudbuild.ListBuildsResponse) error {
+		builds = append(builds, resp.Builds...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if selected != "" && findBuild(builds, selected) < 0 {
+		b, err := ui.api.Projects.Builds.Get(*projectID, selected).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		builds = append(builds, b)
+	}
+	return builds, nil
+}
+
+// show replaces the builds shown, keeping the selection if it is among them.
+func (ui *topUI) show(builds []*cloudbuild.Build) {
+	ui.builds = builds
+	if findBuild(builds, ui.selected) < 0 {
+		ui.selected = ""
+		if len(builds) > 0 {
+			ui.selected = builds[0].Id
+		}
+	}
+}
+
+func findBuild(builds []*cloudbuild.Build, id string) int {
+	for i, b := range builds {
+		if b.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (ui *topUI) current() *cloudbuild.Build {
+	if i := findBuild(ui.builds, ui.selected); i >= 0 {
+		return ui.builds[i]
+	}
+	return nil
+}
+
+// handleKey acts on a key press, returning false if the UI should exit.
+func (ui *topUI) handleKey(ctx context.Context, k string) bool {
+	if ui.confirm {
+		ui.confirm = false
+		if k == "y" {
+			ui.cancel(ctx)
+		} else {
+			ui.message = ""
+		}
+		return true
+	}
+	ui.message = ""
+	switch k {
+	case "q":
+		return false
+	case keyEsc:
+		ui.view = viewList
+		ui.log = nil
+	case keyUp, "k":
+		ui.move(-1)
+	case keyDown, "j":
+		ui.move(1)
+	case keyEnter, "d":
+		if ui.current() != nil {
+			ui.view = viewDetails
+		}
+	case "l":
+		if b := ui.current(); b != nil {
+			ui.view = viewLogs
+			ui.logs = nil
+			ui.log = newTopLog(ui.gcs, b)
+		}
+	case "c":
+		if b := ui.current(); b != nil {
+			ui.confirm = true
+			ui.message = fmt.Sprintf("Cancel build %s? (y/n)", b.Id)
+		}
+	}
+	return true
+}
+
+func (ui *topUI) move(delta int) {
+	if ui.view != viewList || len(ui.builds) == 0 {
+		return
+	}
+	i := findBuild(ui.builds, ui.selected) + delta
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(ui.builds) {
+		i = len(ui.builds) - 1
+	}
+	ui.selected = ui.builds[i].Id
+}
+
+func (ui *topUI) cancel(ctx context.Context) {
+	b := ui.current()
+	if b == nil {
+		return
+	}
+	_, err := ui.api.Projects.Builds.Cancel(*projectID, b.Id, &cloudbuild.CancelBuildRequest{}).Context(ctx).Do()
+	if err != nil {
+		ui.message = fmt.Sprintf("Could not cancel build %s: %v", b.Id, err)
+		return
+	}
+	ui.message = fmt.Sprintf("Cancelled build %s.", b.Id)
+}
+
+// draw renders the current view to the terminal.
+func (ui *topUI) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	var lines []string
+	highlight := -1
+	switch ui.view {
+	case viewList:
+		lines, highlight = ui.listLines()
+	case viewDetails:
+		lines = ui.detailLines()
+	case viewLogs:
+		lines = ui.logLines(height - 3)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H\x1b[2J")
+	header := fmt.Sprintf("cdbuild top — %s — %d active builds — %s", *projectID, countActive(ui.builds), time.Now().Format("15:04:05"))
+	fmt.Fprintf(&buf, "\x1b[1m%s\x1b[0m\r\n", truncate(header, width))
+	for i, l := range lines {
+		if i >= height-3 {
+			break
+		}
+		if i == highlight {
+			fmt.Fprintf(&buf, "\x1b[7m%s\x1b[0m\r\n", truncate(l, width))
+			continue
+		}
+		buf.WriteString(truncate(l, width) + "\r\n")
+	}
+	fmt.Fprintf(&buf, "\x1b[%d;1H", height-1)
+	buf.WriteString(truncate(ui.message, width) + "\r\n")
+	help := "↑/↓ select  enter details  l logs  c cancel  esc back  q quit"
+	fmt.Fprintf(&buf, "\x1b[7m%s\x1b[0m", truncate(help, width))
+	os.Stdout.Write(buf.Bytes())
+}
+
+// listLines returns the lines of the build list, and the index of the line
+// of the selected build.
+func (ui *topUI) listLines() ([]string, int) {
+	selected := -1
+	lines := []string{fmt.Sprintf("  %-36s  %-8s  %-9s  %-30s  %s", "BUILD", "STATUS", "ELAPSED", "STEP", "IMAGES")}
+	for _, b := range ui.builds {
+		l := fmt.Sprintf("  %-36s  %-8s  %-9s  %-30s  %s", b.Id, b.Status, elapsed(b), currentStep(b), strings.Join(b.Images, ","))
+		if b.Id == ui.selected {
+			selected = len(lines)
+		}
+		lines = append(lines, l)
+	}
+	if len(ui.builds) == 0 {
+		lines = append(lines, "  No active builds.")
+	}
+	return lines, selected
+}
+
+func (ui *topUI) detailLines() []string {
+	b := ui.current()
+	if b == nil {
+		return []string{"Build not found."}
+	}
+	lines := []string{
+		"ID:       " + b.Id,
+		"Status:   " + b.Status,
+		"Created:  " + b.CreateTime,
+		"Elapsed:  " + elapsed(b),
+		"Images:   " + strings.Join(b.Images, ", "),
+		"Logs:     " + b.LogUrl,
+		"",
+		"Steps:",
+	}
+	for i, s := range b.Steps {
+		d := ""
+		if s.Timing != nil {
+			if t, ok := timeSpan(s.Timing.StartTime, s.Timing.EndTime); ok {
+				d = t.Round(time.Second).String()
+			}
+		}
+		lines = append(lines, fmt.Sprintf("  %-30s  %-8s  %s", stepName(i, s), s.Status, d))
+	}
+	return lines
+}
+
+func (ui *topUI) logLines(n int) []string {
+	if len(ui.logs) == 0 {
+		return []string{"Waiting for log output..."}
+	}
+	if n > 0 && len(ui.logs) > n {
+		return ui.logs[len(ui.logs)-n:]
+	}
+	return ui.logs
+}
+
+func countActive(builds []*cloudbuild.Build) int {
+	n := 0
+	for _, b := range builds {
+		if b.Status == "WORKING" || b.Status == "QUEUED" {
+			n++
+		}
+	}
+	return n
+}
+
+// currentStep returns the name of the step that b is running.
+func currentStep(b *cloudbuild.Build) string {
+	for i, s := range b.Steps {
+		if s.Status == "WORKING" {
+			return fmt.Sprintf("%d/%d %s", i+1, len(b.Steps), stepName(i, s))
+		}
+	}
+	return ""
+}
+
+// elapsed returns how long b has been queued or running.
+func elapsed(b *cloudbuild.Build) string {
+	start, err := time.Parse(time.RFC3339Nano, b.CreateTime)
+	if err != nil {
+		return ""
+	}
+	end := time.Now()
+	if t, err := time.Parse(time.RFC3339Nano, b.FinishTime); err == nil {
+		end = t
+	}
+	return end.Sub(start).Round(time.Second).String()
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if n <= 0 || len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
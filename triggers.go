@@ -0,0 +1,326 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// triggerSpec is a build trigger as declared in a triggers file.
+type triggerSpec struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description,omitempty"`
+	// Repo is either github.com/owner/name or the name of a Cloud Source
+	// Repository in the project.
+	Repo string `yaml:"repo"`
+	// Branch or Tag is a regular expression of the refs that trigger a build.
+	Branch         string            `yaml:"branch,omitempty"`
+	Tag            string            `yaml:"tag,omitempty"`
+	Config         string            `yaml:"config"` // Path of the build config in the repo.
+	Substitutions  map[string]string `yaml:"substitutions,omitempty"`
+	IncludedFiles  []string          `yaml:"includedFiles,omitempty"`
+	IgnoredFiles   []string          `yaml:"ignoredFiles,omitempty"`
+	ServiceAccount string            `yaml:"serviceAccount,omitempty"`
+	Disabled       bool              `yaml:"disabled,omitempty"`
+}
+
+func triggersCmd(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s triggers apply -f triggers.yaml [-prune] [-dry-run]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s triggers export\n", os.Args[0])
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	switch args[0] {
+	case "apply":
+		triggersApply(args[1:])
+	case "export":
+		triggersExport(args[1:])
+	default:
+		usage()
+	}
+}
+
+func triggersApply(args []string) {
+	fs := commandFlags("triggers apply", "")
+	file := fs.String("f", "", "YAML file of build triggers. Required.")
+	prune := fs.Bool("prune", false, "Delete triggers in the project that the file does not declare.")
+	dryRun := fs.Bool("dry-run", false, "Only show the changes.")
+	parseCommandFlags(fs, args)
+	if *file == "" {
+		logger.Error("Missing 'f' flag.")
+		fs.Usage()
+		os.Exit(2)
+	}
+	specs, err := readTriggers(*file)
+	if err != nil {
+		fatal(logger, "Could not read triggers", err)
+	}
+
+	ctx := context.Background()
+	_, api, err := newCloudBuild(ctx)
+	if err != nil {
+		fatal(logger, "Could not create client", err)
+	}
+	existing, err := listTriggers(ctx, api)
+	if err != nil {
+		fatal(logger, "Could not list triggers", err)
+	}
+
+	// changes are applied in order once they have all been shown.
+	var changes []func() error
+	declared := make(map[string]bool)
+	for _, s := range specs {
+		s := s
+		declared[s.Name] = true
+		t, ok := existing[s.Name]
+		if !ok {
+			fmt.Printf("+ %s\n", s.Name)
+			changes = append(changes, func() error {
+				_, err := api.Projects.Triggers.Create(*projectID, s.trigger()).Context(ctx).Do()
+				return err
+			})
+			continue
+		}
+		cur, _ := specFromTrigger(t)
+		diff := cur.diff(s)
+		if len(diff) == 0 {
+			continue
+		}
+		fmt.Printf("~ %s\n", s.Name)
+		for _, d := range diff {
+			fmt.Printf("    %s\n", d)
+		}
+		id := t.Id
+		changes = append(changes, func() error {
+			nt := s.trigger()
+			nt.Id = id
+			_, err := api.Projects.Triggers.Patch(*projectID, id, nt).Context(ctx).Do()
+			return err
+		})
+	}
+	var names []string
+	for n := range existing {
+		if !declared[n] {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		t := existing[n]
+		if _, ok := specFromTrigger(t); !ok {
+			logger.Warn("Not managing trigger that a triggers file cannot describe", "trigger", n)
+			continue
+		}
+		if !*prune {
+			fmt.Printf("  %s (not declared; use -prune to delete)\n", n)
+			continue
+		}
+		fmt.Printf("- %s\n", n)
+		changes = append(changes, func() error {
+			_, err := api.Projects.Triggers.Delete(*projectID, t.Id).Context(ctx).Do()
+			return err
+		})
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("Triggers are up to date.")
+		return
+	}
+	if *dryRun {
+		fmt.Printf("%d changes. Run without -dry-run to apply them.\n", len(changes))
+		return
+	}
+	for _, c := range changes {
+		if err := c(); err != nil {
+			fatal(logger, "Could not update trigger", err)
+		}
+	}
+	fmt.Printf("Applied %d changes.\n", len(changes))
+}
+
+func triggersExport(args []string) {
+	fs := commandFlags("triggers export", "")
+	parseCommandFlags(fs, args)
+
+	ctx := context.Background()
+	_, api, err := newCloudBuild(ctx)
+	if err != nil {
+		fatal(logger, "Could not create client", err)
+	}
+	existing, err := listTriggers(ctx, api)
+	if err != nil {
+		fatal(logger, "Could not list triggers", err)
+	}
+	var names []string
+	for n := range existing {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var specs []triggerSpec
+	for _, n := range names {
+		s, ok := specFromTrigger(existing[n])
+		if !ok {
+			logger.Warn("Skipping trigger that a triggers file cannot describe", "trigger", n)
+			continue
+		}
+		specs = append(specs, s)
+	}
+	b, err := yaml.Marshal(specs)
+	if err != nil {
+		fatal(logger, "Could not encode triggers", err)
+	}
+	os.Stdout.Write(b)
+}
+
+// readTriggers reads and validates a triggers file.
+func readTriggers(name string) ([]triggerSpec, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var specs []triggerSpec
+	if err := yaml.UnmarshalStrict(b, &specs); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", name, err)
+	}
+	seen := make(map[string]bool)
+	for i, s := range specs {
+		switch {
+		case s.Name == "":
+			return nil, fmt.Errorf("trigger %d has no name", i+1)
+		case seen[s.Name]:
+			return nil, fmt.Errorf("trigger %s is declared twice", s.Name)
+		case s.Repo == "":
+			return nil, fmt.Errorf("trigger %s has no repo", s.Name)
+		case (s.Branch == "") == (s.Tag == ""):
+			return nil, fmt.Errorf("trigger %s must have exactly one of branch and tag", s.Name)
+		case s.Config == "":
+			return nil, fmt.Errorf("trigger %s has no config", s.Name)
+		}
+		seen[s.Name] = true
+	}
+	return specs, nil
+}
+
+// listTriggers returns the project's build triggers by name.
+func listTriggers(ctx context.Context, api *cloudbuild.Service) (map[string]*cloudbuild.BuildTrigger, error) {
+	triggers := make(map[string]*cloudbuild.BuildTrigger)
+	err := api.Projects.Triggers.List(*projectID).Pages(ctx, func(resp *cloudbuild.ListBuildTriggersResponse) error {
+		for _, t := range resp.Triggers {
+			triggers[t.Name] = t
+		}
+		return nil
+	})
+	return triggers, err
+}
+
+// trigger returns the build trigger that s declares.
+func (s triggerSpec) trigger() *cloudbuild.BuildTrigger {
+	t := &cloudbuild.BuildTrigger{
+		Name:           s.Name,
+		Description:    s.Description,
+		Filename:       s.Config,
+		Substitutions:  s.Substitutions,
+		IncludedFiles:  s.IncludedFiles,
+		IgnoredFiles:   s.IgnoredFiles,
+		ServiceAccount: s.ServiceAccount,
+		Disabled:       s.Disabled,
+	}
+	if gh := strings.TrimPrefix(s.Repo, "github.com/"); gh != s.Repo {
+		owner, name := splitRepo(gh)
+		t.Github = &cloudbuild.GitHubEventsConfig{
+			Owner: owner,
+			Name:  name,
+			Push:  &cloudbuild.PushFilter{Branch: s.Branch, Tag: s.Tag},
+		}
+		return t
+	}
+	t.TriggerTemplate = &cloudbuild.RepoSource{
+		ProjectId:  *projectID,
+		RepoName:   s.Repo,
+		BranchName: s.Branch,
+		TagName:    s.Tag,
+	}
+	return t
+}
+
+func splitRepo(s string) (owner, name string) {
+	if i := strings.Index(s, "/"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return "", s
+}
+
+// specFromTrigger returns the declaration of t, or false if t uses features
+// that a triggers file cannot describe, such as an inline build or a Pub/Sub
+// event.
+func specFromTrigger(t *cloudbuild.BuildTrigger) (triggerSpec, bool) {
+	s := triggerSpec{
+		Name:           t.Name,
+		Description:    t.Description,
+		Config:         t.Filename,
+		Substitutions:  t.Substitutions,
+		IncludedFiles:  t.IncludedFiles,
+		IgnoredFiles:   t.IgnoredFiles,
+		ServiceAccount: t.ServiceAccount,
+		Disabled:       t.Disabled,
+	}
+	switch {
+	case t.Github != nil && t.Github.Push != nil && !t.Github.Push.InvertRegex:
+		s.Repo = "github.com/" + t.Github.Owner + "/" + t.Github.Name
+		s.Branch, s.Tag = t.Github.Push.Branch, t.Github.Push.Tag
+	case t.TriggerTemplate != nil && !t.TriggerTemplate.InvertRegex && t.TriggerTemplate.Dir == "":
+		s.Repo = t.TriggerTemplate.RepoName
+		s.Branch, s.Tag = t.TriggerTemplate.BranchName, t.TriggerTemplate.TagName
+	default:
+		return s, false
+	}
+	return s, s.Config != "" && t.Build == nil
+}
+
+// diff describes how s differs from t, one field per line.
+func (s triggerSpec) diff(t triggerSpec) []string {
+	a, b := s.fields(), t.fields()
+	var d []string
+	for i := range a {
+		if a[i][1] != b[i][1] {
+			d = append(d, fmt.Sprintf("%s: %s -> %s", a[i][0], a[i][1], b[i][1]))
+		}
+	}
+	return d
+}
+
+// fields returns the names and formatted values of s's fields, in a fixed
+// order.
+func (s triggerSpec) fields() [][2]string {
+	var subs []string
+	for k, v := range s.Substitutions {
+		subs = append(subs, k+"="+v)
+	}
+	sort.Strings(subs)
+	list := func(l []string) string { return "[" + strings.Join(l, ", ") + "]" }
+	return [][2]string{
+		{"description", fmt.Sprintf("%q", s.Description)},
+		{"repo", s.Repo},
+		{"branch", fmt.Sprintf("%q", s.Branch)},
+		{"tag", fmt.Sprintf("%q", s.Tag)},
+		{"config", s.Config},
+		{"substitutions", list(subs)},
+		{"includedFiles", list(s.IncludedFiles)},
+		{"ignoredFiles", list(s.IgnoredFiles)},
+		{"serviceAccount", fmt.Sprintf("%q", s.ServiceAccount)},
+		{"disabled", fmt.Sprint(s.Disabled)},
+	}
+}
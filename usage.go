@@ -0,0 +1,297 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/context"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultPrices are the Cloud Build prices in USD per build minute for each
+// machine type. They can be overridden with the -prices flag.
+var defaultPrices = map[string]float64{
+	"default":       0.003,
+	"E2_HIGHCPU_8":  0.016,
+	"E2_HIGHCPU_32": 0.064,
+	"N1_HIGHCPU_8":  0.016,
+	"N1_HIGHCPU_32": 0.064,
+}
+
+// usageRow is the usage of one group of builds.
+type usageRow struct {
+	Group       string             `json:"group"`
+	Builds      int                `json:"builds"`
+	Failures    int                `json:"failures"`
+	FailureRate float64            `json:"failureRate"`
+	Minutes     map[string]float64 `json:"minutesByMachineType"`
+	TotalMins   float64            `json:"minutes"`
+	Cost        float64            `json:"estimatedCost"`
+	// UnpricedMins are minutes on machine types with no known price,
+	// which are not in Cost.
+	UnpricedMins float64 `json:"unpricedMinutes"`
+	PrevMins     float64 `json:"previousMinutes"`
+	// Trend is the percentage change in minutes from the previous period
+	// of the same length, or nil if there were no builds in that period.
+	Trend *float64 `json:"trend"`
+}
+
+func usageCmd(args []string) {
+	fs := commandFlags("usage", "")
+	since := fs.String("since", "30d", "Report builds created within this period, e.g. 30d or 12h. Trends compare against the period before it.")
+	groupBy := fs.String("group-by", "image", "Group builds by: image, tag, trigger or build-tag.")
+	format := fs.String("format", "table", "Output format: table, csv or json.")
+	pricesFile := fs.String("prices", "", "YAML or JSON file mapping machine types to USD per build minute. Defaults to Cloud Build list prices.")
+	parseCommandFlags(fs, args)
+
+	age, err := parseAge(*since)
+	if err != nil {
+		logger.Error("Invalid -since", "error", err.Error())
+		os.Exit(2)
+	}
+	keys, ok := usageGroupers[*groupBy]
+	if !ok {
+		logger.Error("Invalid -group-by", "group_by", *groupBy)
+		os.Exit(2)
+	}
+	prices := defaultPrices
+	if *pricesFile != "" {
+		if prices, err = readPrices(*pricesFile); err != nil {
+			fatal(logger, "Could not read prices", err)
+		}
+	}
+
+	ctx := context.Background()
+	_, api, err := newCloudBuild(ctx)
+	if err != nil {
+		fatal(logger, "Could not create client", err)
+	}
+
+	now := time.Now()
+	start := now.Add(-age)
+	rows := make(map[string]*usageRow)
+	unpriced := make(map[string]bool)
+	err = listBuilds(ctx, api, start.Add(-age), "", func(b *cloudbuild.Build) {
+		created, err := time.Parse(time.RFC3339Nano, b.CreateTime)
+		if err != nil {
+			return
+		}
+		d, _ := buildDuration(b)
+		mins := d.Minutes()
+		for _, k := range keys(b) {
+			r, ok := rows[k]
+			if !ok {
+				r = &usageRow{Group: k, Minutes: make(map[string]float64)}
+				rows[k] = r
+			}
+			if created.Before(start) {
+				r.PrevMins += mins
+				continue
+			}
+			r.Builds++
+			if failed(b) {
+				r.Failures++
+			}
+			if mt := machineType(b); !r.add(mt, mins, prices) {
+				unpriced[mt] = true
+			}
+		}
+	})
+	if err != nil {
+		fatal(logger, "Could not list builds", err)
+	}
+
+	var out []*usageRow
+	for _, r := range rows {
+		if r.Builds == 0 {
+			continue
+		}
+		r.FailureRate = float64(r.Failures) / float64(r.Builds)
+		if r.PrevMins > 0 {
+			t := (r.TotalMins - r.PrevMins) / r.PrevMins * 100
+			r.Trend = &t
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Cost > out[j].Cost })
+	if len(unpriced) > 0 {
+		var types []string
+		for mt := range unpriced {
+			types = append(types, mt)
+		}
+		sort.Strings(types)
+		logger.Warn("Machine types have no price; costs marked + leave out their minutes",
+			"machine_types", strings.Join(types, ","), "prices_flag", "-prices")
+	}
+
+	switch *format {
+	case "table":
+		err = writeUsageTable(os.Stdout, out)
+	case "csv":
+		err = writeUsageCSV(os.Stdout, out)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(out)
+	default:
+		logger.Error("Invalid -format", "format", *format)
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(logger, "Could not write report", err)
+	}
+}
+
+// usageGroupers return the groups that a build is counted in.
+var usageGroupers = map[string]func(*cloudbuild.Build) []string{
+	"image": func(b *cloudbuild.Build) []string {
+		if len(b.Images) == 0 {
+			return []string{"(no image)"}
+		}
+		repo, _ := splitTag(b.Images[0])
+		return []string{repo}
+	},
+	"tag": func(b *cloudbuild.Build) []string {
+		if len(b.Images) == 0 {
+			return []string{"(no image)"}
+		}
+		return []string{b.Images[0]}
+	},
+	"trigger": func(b *cloudbuild.Build) []string {
+		if b.BuildTriggerId == "" {
+			return []string{"(manual)"}
+		}
+		return []string{b.BuildTriggerId}
+	},
+	"build-tag": func(b *cloudbuild.Build) []string {
+		var tags []string
+		for _, t := range b.Tags {
+			if !strings.HasPrefix(t, sourceTagPrefix) {
+				tags = append(tags, t)
+			}
+		}
+		if len(tags) == 0 {
+			return []string{"(untagged)"}
+		}
+		return tags
+	},
+}
+
+// add counts mins build minutes on machine type mt, and reports whether mt
+// has a price.
+func (r *usageRow) add(mt string, mins float64, prices map[string]float64) bool {
+	r.Minutes[mt] += mins
+	r.TotalMins += mins
+	price, ok := prices[mt]
+	if !ok {
+		r.UnpricedMins += mins
+		return false
+	}
+	r.Cost += mins * price
+	return true
+}
+
+// failed reports whether build b finished unsuccessfully.
+func failed(b *cloudbuild.Build) bool {
+	switch b.Status {
+	case "FAILURE", "INTERNAL_ERROR", "TIMEOUT":
+		return true
+	}
+	return false
+}
+
+func machineType(b *cloudbuild.Build) string {
+	if b.Options == nil || b.Options.MachineType == "" || b.Options.MachineType == "UNSPECIFIED" {
+		return "default"
+	}
+	return b.Options.MachineType
+}
+
+func readPrices(name string) (map[string]float64, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var prices map[string]float64
+	if err := yaml.Unmarshal(b, &prices); err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+func formatTrend(t *float64) string {
+	if t == nil {
+		return "new"
+	}
+	return fmt.Sprintf("%+.0f%%", *t)
+}
+
+// formatCost formats the estimated cost of r, marked with "+" if some of its
+// minutes have no price.
+func formatCost(r *usageRow) string {
+	s := fmt.Sprintf("$%.2f", r.Cost)
+	if r.UnpricedMins > 0 {
+		s += "+"
+	}
+	return s
+}
+
+func writeUsageTable(w io.Writer, rows []*usageRow) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tBUILDS\tFAILED\tMINUTES\tEST. COST\tTREND")
+	var total usageRow
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%d\t%.0f%%\t%.1f\t%s\t%s\n",
+			r.Group, r.Builds, r.FailureRate*100, r.TotalMins, formatCost(r), formatTrend(r.Trend))
+		total.Builds += r.Builds
+		total.TotalMins += r.TotalMins
+		total.Cost += r.Cost
+		total.UnpricedMins += r.UnpricedMins
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t\t%.1f\t%s\t\n", total.Builds, total.TotalMins, formatCost(&total))
+	return tw.Flush()
+}
+
+func writeUsageCSV(w io.Writer, rows []*usageRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"group", "builds", "failures", "failure_rate", "minutes", "minutes_by_machine_type", "estimated_cost", "unpriced_minutes", "previous_minutes", "trend_percent"})
+	for _, r := range rows {
+		var byType []string
+		for mt, m := range r.Minutes {
+			byType = append(byType, fmt.Sprintf("%s=%.1f", mt, m))
+		}
+		sort.Strings(byType)
+		trend := ""
+		if r.Trend != nil {
+			trend = strconv.FormatFloat(*r.Trend, 'f', 1, 64)
+		}
+		cw.Write([]string{
+			r.Group,
+			strconv.Itoa(r.Builds),
+			strconv.Itoa(r.Failures),
+			strconv.FormatFloat(r.FailureRate, 'f', 3, 64),
+			strconv.FormatFloat(r.TotalMins, 'f', 1, 64),
+			strings.Join(byType, ";"),
+			strconv.FormatFloat(r.Cost, 'f', 2, 64),
+			strconv.FormatFloat(r.UnpricedMins, 'f', 1, 64),
+			strconv.FormatFloat(r.PrevMins, 'f', 1, 64),
+			trend,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,31 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUsageRowUnpriced(t *testing.T) {
+	r := &usageRow{Group: "gcr.io/p/app", Builds: 2, Minutes: make(map[string]float64)}
+	if !r.add("E2_HIGHCPU_8", 10, defaultPrices) {
+		t.Error("E2_HIGHCPU_8 has no price")
+	}
+	if r.add("E2_MEDIUM", 5, defaultPrices) {
+		t.Error("E2_MEDIUM has a price")
+	}
+	if r.TotalMins != 15 || r.UnpricedMins != 5 || r.Cost != 10*defaultPrices["E2_HIGHCPU_8"] {
+		t.Errorf("row = %+v, want 15 minutes, 5 unpriced, cost of 10 minutes", r)
+	}
+	var buf bytes.Buffer
+	if err := writeUsageTable(&buf, []*usageRow{r}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "$0.16+") {
+		t.Errorf("table does not mark the cost as partial:\n%s", buf.String())
+	}
+}